@@ -0,0 +1,33 @@
+package ploop
+
+// Backend is an interface to ploop operations that do not require
+// an opened DiskDescriptor.xml, plus Open() to get one.
+//
+// Code which uses Backend and Disk interfaces rather than calling
+// package functions and Ploop methods directly can be unit tested
+// using an in-memory fake backend from ploopfake package, on hosts
+// without ploop (build with CGO_ENABLED=0 if libploop is not installed).
+type Backend interface {
+	// Create creates a ploop image and its DiskDescriptor.xml
+	Create(p *CreateParam) error
+	// Open opens a ploop DiskDescriptor.xml
+	Open(file string) (Disk, error)
+	// FSInfo gets info of ploop's inner file system
+	FSInfo(file string) (FSInfoData, error)
+}
+
+// Disk is an interface to operations on an opened DiskDescriptor.xml.
+// It is implemented by Ploop; see Ploop methods for documentation.
+type Disk interface {
+	Close()
+	Mount(p *MountParam) (string, error)
+	Umount() error
+	Resize(size uint64, offline bool) error
+	Snapshot() (string, error)
+	SwitchSnapshot(uuid string) error
+	DeleteSnapshot(uuid string) error
+	Replace(p *ReplaceParam) error
+	IsMounted() (bool, error)
+	ImageInfo() (ImageInfoData, error)
+	TopDeltaFile() (string, error)
+}
@@ -0,0 +1,549 @@
+// Package descriptor reads and writes ploop DiskDescriptor.xml files
+// without the need for libploop, cgo, or a ploop-enabled kernel.
+//
+// The output produced by this package is byte-to-byte identical to the
+// one written by libploop, so a descriptor can be loaded, modified and
+// saved back without libploop noticing any difference.
+package descriptor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileName is the default name of a ploop disk descriptor
+const FileName = "DiskDescriptor.xml"
+
+// NoneUUID is used as a parent GUID of a base delta
+const NoneUUID = "{00000000-0000-0000-0000-000000000000}"
+
+// TopDeltaGUID is the GUID libploop always gives to the top delta
+// (TOPDELTA_UUID); a delta gets a new GUID once a snapshot is taken
+const TopDeltaGUID = "{5fbaabe3-6958-40ff-92a7-860e329aab41}"
+
+// Default disk geometry, as used by libploop
+const (
+	DefaultHeads   = 16
+	DefaultSectors = 63
+)
+
+// Possible values for Image.Type
+const (
+	TypeExpanded = "Compressed" // expanded and preallocated images
+	TypeRaw      = "Plain"      // raw images
+)
+
+// Image describes a single delta file of a ploop
+type Image struct {
+	GUID string // image (and snapshot) GUID, in {...} form
+	Type string // TypeExpanded or TypeRaw
+	File string // delta file name, relative to descriptor directory or absolute
+}
+
+// Snapshot describes a ploop snapshot, i.e. a link
+// between an image and its parent
+type Snapshot struct {
+	GUID       string // same as GUID of a corresponding Image
+	ParentGUID string // NoneUUID for a base delta
+	Temporary  bool   // snapshot is temporary (i.e. created for internal needs)
+
+	// Metadata, not known to (and not preserved by) libploop
+	Description string            // human readable description
+	Created     time.Time         // creation time (zero if unknown)
+	Labels      map[string]string // arbitrary key/value labels
+}
+
+// HasMeta returns true if a snapshot has any metadata set
+func (s *Snapshot) HasMeta() bool {
+	return s.Description != "" || !s.Created.IsZero() || len(s.Labels) != 0
+}
+
+// Descriptor is an in-memory representation of DiskDescriptor.xml
+type Descriptor struct {
+	Size         uint64 // disk size, in 512-byte sectors
+	Cylinders    uint32
+	Heads        uint32
+	Sectors      uint32
+	Padding      uint32
+	MaxDeltaSize uint64 // maximum delta size, in 512-byte sectors (0 if unset)
+	KeyID        string // encryption key ID (empty if not encrypted)
+	BlockSize    uint32 // cluster block size, in 512-byte sectors
+	Images       []Image
+	TopGUID      string
+	Snapshots    []Snapshot
+
+	dir string // directory the descriptor was loaded from
+}
+
+// XML representation, for reading only (writing is done by hand
+// to match libploop output exactly, see WriteTo)
+type xmlImage struct {
+	GUID string `xml:"GUID"`
+	Type string `xml:"Type"`
+	File string `xml:"File"`
+}
+
+type xmlShot struct {
+	GUID       string    `xml:"GUID"`
+	ParentGUID string    `xml:"ParentGUID"`
+	Temporary  *struct{} `xml:"Temporary"`
+
+	Description string     `xml:"Description"`
+	Created     string     `xml:"Created"`
+	Labels      []xmlLabel `xml:"Labels>Label"`
+}
+
+type xmlLabel struct {
+	Name  string `xml:"Name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlDescriptor struct {
+	XMLName xml.Name `xml:"Parallels_disk_image"`
+	Params  struct {
+		Size         uint64 `xml:"Disk_size"`
+		MaxDeltaSize uint64 `xml:"Max_delta_size"`
+		Cylinders    uint32 `xml:"Cylinders"`
+		Heads        uint32 `xml:"Heads"`
+		Sectors      uint32 `xml:"Sectors"`
+		Padding      uint32 `xml:"Padding"`
+		KeyID        string `xml:"Encryption>KeyId"`
+	} `xml:"Disk_Parameters"`
+	Storage struct {
+		Start     uint64     `xml:"Start"`
+		End       uint64     `xml:"End"`
+		BlockSize uint32     `xml:"Blocksize"`
+		Images    []xmlImage `xml:"Image"`
+	} `xml:"StorageData>Storage"`
+	TopGUID string    `xml:"Snapshots>TopGUID"`
+	Shots   []xmlShot `xml:"Snapshots>Shot"`
+}
+
+// NewGUID returns a new random (version 4) GUID, in {...} form
+func NewGUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("{%x-%x-%x-%x-%x}", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// New returns a descriptor of a new ploop of a given size and block
+// size (both in 512-byte sectors), consisting of a single base delta
+// image file, with a default disk geometry. As with libploop, the
+// delta, being the top one, has TopDeltaGUID.
+func New(size uint64, blockSize uint32, file string) *Descriptor {
+	guid := TopDeltaGUID
+
+	return &Descriptor{
+		Size:      size,
+		Cylinders: uint32(size / (DefaultHeads * DefaultSectors)),
+		Heads:     DefaultHeads,
+		Sectors:   DefaultSectors,
+		BlockSize: blockSize,
+		Images:    []Image{{GUID: guid, Type: TypeExpanded, File: file}},
+		TopGUID:   guid,
+		Snapshots: []Snapshot{{GUID: guid, ParentGUID: NoneUUID}},
+	}
+}
+
+// Read parses a disk descriptor from r
+func Read(r io.Reader) (*Descriptor, error) {
+	var x xmlDescriptor
+
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, fmt.Errorf("descriptor: can't parse: %w", err)
+	}
+
+	d := &Descriptor{
+		Size:         x.Params.Size,
+		Cylinders:    x.Params.Cylinders,
+		Heads:        x.Params.Heads,
+		Sectors:      x.Params.Sectors,
+		Padding:      x.Params.Padding,
+		MaxDeltaSize: x.Params.MaxDeltaSize,
+		KeyID:        x.Params.KeyID,
+		BlockSize:    x.Storage.BlockSize,
+		TopGUID:      strings.TrimSpace(x.TopGUID),
+	}
+	for _, i := range x.Storage.Images {
+		d.Images = append(d.Images, Image{
+			GUID: strings.TrimSpace(i.GUID),
+			Type: strings.TrimSpace(i.Type),
+			File: strings.TrimSpace(i.File),
+		})
+	}
+	for _, s := range x.Shots {
+		shot := Snapshot{
+			GUID:        strings.TrimSpace(s.GUID),
+			ParentGUID:  strings.TrimSpace(s.ParentGUID),
+			Temporary:   s.Temporary != nil,
+			Description: s.Description,
+		}
+		// metadata is informational, so a malformed value
+		// is ignored rather than making the descriptor unreadable
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(s.Created)); err == nil {
+			shot.Created = t
+		}
+		for _, l := range s.Labels {
+			if shot.Labels == nil {
+				shot.Labels = make(map[string]string)
+			}
+			shot.Labels[l.Name] = l.Value
+		}
+		d.Snapshots = append(d.Snapshots, shot)
+	}
+
+	return d, nil
+}
+
+// Load reads and validates a disk descriptor from a file.
+// If path is a directory, FileName is appended to it.
+func Load(path string) (*Descriptor, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, FileName)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := Read(f)
+	if err != nil {
+		return nil, err
+	}
+	d.dir = filepath.Dir(path)
+
+	return d, d.Validate()
+}
+
+// Dir returns the directory the descriptor was loaded from
+// (or last saved to), or an empty string.
+func (d *Descriptor) Dir() string {
+	return d.dir
+}
+
+// ImagePath returns a path to the image file. Relative file names are
+// resolved against the directory the descriptor was loaded from.
+func (d *Descriptor) ImagePath(i *Image) string {
+	if filepath.IsAbs(i.File) || d.dir == "" {
+		return i.File
+	}
+	return filepath.Join(d.dir, i.File)
+}
+
+// Image returns an image with a given GUID, or nil if not found
+func (d *Descriptor) Image(guid string) *Image {
+	for n := range d.Images {
+		if d.Images[n].GUID == guid {
+			return &d.Images[n]
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a snapshot with a given GUID, or nil if not found
+func (d *Descriptor) Snapshot(guid string) *Snapshot {
+	for n := range d.Snapshots {
+		if d.Snapshots[n].GUID == guid {
+			return &d.Snapshots[n]
+		}
+	}
+	return nil
+}
+
+// Top returns the top delta image, or nil if not found
+func (d *Descriptor) Top() *Image {
+	return d.Image(d.TopGUID)
+}
+
+// Chain returns the chain of images from a given GUID (top) down to
+// the base delta, following snapshot parent links. If guid is empty,
+// TopGUID is used.
+func (d *Descriptor) Chain(guid string) ([]*Image, error) {
+	if guid == "" {
+		guid = d.TopGUID
+	}
+
+	var chain []*Image
+	for guid != NoneUUID {
+		if len(chain) > len(d.Snapshots) {
+			return nil, errors.New("descriptor: snapshot loop detected")
+		}
+		i := d.Image(guid)
+		if i == nil {
+			return nil, fmt.Errorf("descriptor: no image with GUID %s", guid)
+		}
+		s := d.Snapshot(guid)
+		if s == nil {
+			return nil, fmt.Errorf("descriptor: no snapshot with GUID %s", guid)
+		}
+		chain = append(chain, i)
+		guid = s.ParentGUID
+	}
+
+	return chain, nil
+}
+
+// Children returns GUIDs of snapshots which have guid as a parent
+func (d *Descriptor) Children(guid string) []string {
+	var ret []string
+	for _, s := range d.Snapshots {
+		if s.ParentGUID == guid {
+			ret = append(ret, s.GUID)
+		}
+	}
+	return ret
+}
+
+// AddDelta adds a new image on top of the current top one,
+// making it the new top delta.
+func (d *Descriptor) AddDelta(guid, file string) error {
+	if d.Image(guid) != nil || d.Snapshot(guid) != nil {
+		return fmt.Errorf("descriptor: GUID %s already exists", guid)
+	}
+	parent := d.TopGUID
+	if parent == "" {
+		parent = NoneUUID
+	}
+	typ := TypeExpanded
+	if t := d.Top(); t != nil {
+		typ = t.Type
+	}
+
+	d.Images = append(d.Images, Image{GUID: guid, Type: typ, File: file})
+	d.Snapshots = append(d.Snapshots, Snapshot{GUID: guid, ParentGUID: parent})
+	d.TopGUID = guid
+
+	return nil
+}
+
+// RemoveDelta removes an image and its snapshot record. Children of
+// the removed snapshot are re-parented to its parent. If the removed
+// image is the top one, its parent becomes the new top.
+func (d *Descriptor) RemoveDelta(guid string) error {
+	s := d.Snapshot(guid)
+	if s == nil {
+		return fmt.Errorf("descriptor: no snapshot with GUID %s", guid)
+	}
+	parent := s.ParentGUID
+
+	for n := range d.Snapshots {
+		if d.Snapshots[n].ParentGUID == guid {
+			d.Snapshots[n].ParentGUID = parent
+		}
+	}
+	for n := range d.Snapshots {
+		if d.Snapshots[n].GUID == guid {
+			d.Snapshots = append(d.Snapshots[:n], d.Snapshots[n+1:]...)
+			break
+		}
+	}
+	for n := range d.Images {
+		if d.Images[n].GUID == guid {
+			d.Images = append(d.Images[:n], d.Images[n+1:]...)
+			break
+		}
+	}
+	if d.TopGUID == guid {
+		d.TopGUID = parent
+	}
+
+	return nil
+}
+
+// Validate checks the descriptor for consistency
+func (d *Descriptor) Validate() error {
+	if d.Size == 0 {
+		return errors.New("descriptor: disk size is not set")
+	}
+	if d.BlockSize == 0 || d.BlockSize&(d.BlockSize-1) != 0 {
+		return fmt.Errorf("descriptor: invalid block size %d", d.BlockSize)
+	}
+	if len(d.Images) == 0 {
+		return errors.New("descriptor: no images")
+	}
+
+	seen := make(map[string]bool)
+	for _, i := range d.Images {
+		if i.GUID == "" || i.File == "" {
+			return errors.New("descriptor: image with no GUID or file")
+		}
+		if seen[i.GUID] {
+			return fmt.Errorf("descriptor: duplicate image GUID %s", i.GUID)
+		}
+		seen[i.GUID] = true
+		if i.Type != TypeExpanded && i.Type != TypeRaw {
+			return fmt.Errorf("descriptor: image %s has invalid type %q", i.GUID, i.Type)
+		}
+		if d.Snapshot(i.GUID) == nil {
+			return fmt.Errorf("descriptor: no snapshot for image %s", i.GUID)
+		}
+	}
+
+	bases := 0
+	for _, s := range d.Snapshots {
+		if !seen[s.GUID] {
+			return fmt.Errorf("descriptor: no image for snapshot %s", s.GUID)
+		}
+		if s.ParentGUID == NoneUUID {
+			bases++
+		} else if !seen[s.ParentGUID] {
+			return fmt.Errorf("descriptor: snapshot %s has unknown parent %s", s.GUID, s.ParentGUID)
+		}
+	}
+	if bases != 1 {
+		return fmt.Errorf("descriptor: expected 1 base delta, found %d", bases)
+	}
+	if len(d.Snapshots) != len(d.Images) {
+		return errors.New("descriptor: number of snapshots and images differ")
+	}
+
+	if d.Top() == nil {
+		return fmt.Errorf("descriptor: top GUID %q not found", d.TopGUID)
+	}
+	// check all snapshots lead to the base delta
+	for _, s := range d.Snapshots {
+		if _, err := d.Chain(s.GUID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteTo writes the descriptor to w, in exactly the same format as
+// libploop does. It implements io.WriterTo.
+func (d *Descriptor) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+
+	el := func(indent int, name string, val interface{}) {
+		var s bytes.Buffer
+		xml.EscapeText(&s, []byte(fmt.Sprint(val)))
+		fmt.Fprintf(&b, "%s<%s>%s</%s>\n", strings.Repeat("  ", indent), name, s.String(), name)
+	}
+
+	b.WriteString("<?xml version=\"1.0\"?>\n")
+	b.WriteString("<Parallels_disk_image Version=\"1.0\">\n")
+	b.WriteString("  <Disk_Parameters>\n")
+	el(2, "Disk_size", d.Size)
+	if d.MaxDeltaSize != 0 {
+		el(2, "Max_delta_size", d.MaxDeltaSize)
+	}
+	el(2, "Cylinders", d.Cylinders)
+	el(2, "Heads", d.Heads)
+	el(2, "Sectors", d.Sectors)
+	el(2, "Padding", d.Padding)
+	if d.KeyID != "" {
+		b.WriteString("    <Encryption>\n")
+		el(3, "KeyId", d.KeyID)
+		b.WriteString("    </Encryption>\n")
+	}
+	b.WriteString("  </Disk_Parameters>\n")
+	b.WriteString("  <StorageData>\n")
+	b.WriteString("    <Storage>\n")
+	el(3, "Start", 0)
+	el(3, "End", d.Size)
+	el(3, "Blocksize", d.BlockSize)
+	for _, i := range d.Images {
+		b.WriteString("      <Image>\n")
+		el(4, "GUID", i.GUID)
+		el(4, "Type", i.Type)
+		el(4, "File", i.File)
+		b.WriteString("      </Image>\n")
+	}
+	b.WriteString("    </Storage>\n")
+	b.WriteString("  </StorageData>\n")
+	b.WriteString("  <Snapshots>\n")
+	el(2, "TopGUID", d.TopGUID)
+	for _, s := range d.Snapshots {
+		b.WriteString("    <Shot>\n")
+		el(3, "GUID", s.GUID)
+		el(3, "ParentGUID", s.ParentGUID)
+		if s.Temporary {
+			b.WriteString("      <Temporary/>\n")
+		}
+		if s.Description != "" {
+			el(3, "Description", s.Description)
+		}
+		if !s.Created.IsZero() {
+			el(3, "Created", s.Created.UTC().Format(time.RFC3339))
+		}
+		if len(s.Labels) != 0 {
+			names := make([]string, 0, len(s.Labels))
+			for n := range s.Labels {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			b.WriteString("      <Labels>\n")
+			for _, n := range names {
+				var name, val bytes.Buffer
+				xml.EscapeText(&name, []byte(n))
+				xml.EscapeText(&val, []byte(s.Labels[n]))
+				fmt.Fprintf(&b, "        <Label Name=\"%s\">%s</Label>\n", name.String(), val.String())
+			}
+			b.WriteString("      </Labels>\n")
+		}
+		b.WriteString("    </Shot>\n")
+	}
+	b.WriteString("  </Snapshots>\n")
+	b.WriteString("</Parallels_disk_image>\n")
+
+	return b.WriteTo(w)
+}
+
+// Save validates the descriptor and atomically writes it to a file,
+// by writing to a temporary file first and renaming it. If path is
+// a directory, FileName is appended to it.
+func (d *Descriptor) Save(path string) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, FileName)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = d.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// make sure rename is persistent
+	dir := filepath.Dir(path)
+	if df, err := os.Open(dir); err == nil {
+		df.Sync()
+		df.Close()
+	}
+	d.dir = dir
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package descriptor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	baseGUID = "{5fbaabe3-6958-40ff-92a7-860e329aab41}"
+	topGUID  = "{c8a48a0d-4f1b-4d30-9f63-2d7d2c1a8e9b}"
+)
+
+// sample is a descriptor as written by libploop
+const sample = `<?xml version="1.0"?>
+<Parallels_disk_image Version="1.0">
+  <Disk_Parameters>
+    <Disk_size>786432</Disk_size>
+    <Cylinders>780</Cylinders>
+    <Heads>16</Heads>
+    <Sectors>63</Sectors>
+    <Padding>0</Padding>
+  </Disk_Parameters>
+  <StorageData>
+    <Storage>
+      <Start>0</Start>
+      <End>786432</End>
+      <Blocksize>2048</Blocksize>
+      <Image>
+        <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+        <Type>Compressed</Type>
+        <File>root.hdd</File>
+      </Image>
+      <Image>
+        <GUID>{c8a48a0d-4f1b-4d30-9f63-2d7d2c1a8e9b}</GUID>
+        <Type>Compressed</Type>
+        <File>root.hdd.{c8a48a0d-4f1b-4d30-9f63-2d7d2c1a8e9b}</File>
+      </Image>
+    </Storage>
+  </StorageData>
+  <Snapshots>
+    <TopGUID>{c8a48a0d-4f1b-4d30-9f63-2d7d2c1a8e9b}</TopGUID>
+    <Shot>
+      <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+      <ParentGUID>{00000000-0000-0000-0000-000000000000}</ParentGUID>
+    </Shot>
+    <Shot>
+      <GUID>{c8a48a0d-4f1b-4d30-9f63-2d7d2c1a8e9b}</GUID>
+      <ParentGUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</ParentGUID>
+      <Temporary/>
+    </Shot>
+  </Snapshots>
+</Parallels_disk_image>
+`
+
+func parse(t *testing.T) *Descriptor {
+	d, err := Read(strings.NewReader(sample))
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if err = d.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	return d
+}
+
+func TestRead(t *testing.T) {
+	d := parse(t)
+
+	if d.Size != 786432 || d.BlockSize != 2048 || d.Heads != 16 {
+		t.Errorf("bad disk parameters: %+v", d)
+	}
+	if len(d.Images) != 2 || len(d.Snapshots) != 2 {
+		t.Fatalf("expected 2 images and 2 snapshots, got %d and %d",
+			len(d.Images), len(d.Snapshots))
+	}
+	if d.Top().File != "root.hdd."+topGUID {
+		t.Errorf("bad top image: %+v", d.Top())
+	}
+	if !d.Snapshot(topGUID).Temporary || d.Snapshot(baseGUID).Temporary {
+		t.Errorf("bad temporary flags")
+	}
+}
+
+func TestWriteIdentical(t *testing.T) {
+	d := parse(t)
+
+	var b bytes.Buffer
+	if _, err := d.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	if b.String() != sample {
+		t.Errorf("output differs from input:\n%s", b.String())
+	}
+}
+
+// TestFixtures checks that descriptors in testdata, which are written
+// by libploop's xmlTextWriter code, are reproduced exactly
+func TestFixtures(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.xml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no fixtures found: %v", err)
+	}
+	for _, f := range files {
+		in, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("%s: %s", f, err)
+		}
+		d, err := Load(f)
+		if err != nil {
+			t.Errorf("%s: Load: %s", f, err)
+			continue
+		}
+		var b bytes.Buffer
+		if _, err = d.WriteTo(&b); err != nil {
+			t.Fatalf("%s: WriteTo: %s", f, err)
+		}
+		if b.String() != string(in) {
+			t.Errorf("%s: output differs from input:\n%s", f, b.String())
+		}
+	}
+}
+
+func TestFixtureSnapshots(t *testing.T) {
+	d, err := Load("testdata/snapshots.xml")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	const (
+		top  = "{5fbaabe3-6958-40ff-92a7-860e329aab41}"
+		temp = "{c8a48a0d-4f1b-4d30-9f63-2d7d2c1a8e9b}"
+	)
+	c, err := d.Chain("")
+	if err != nil {
+		t.Fatalf("Chain: %s", err)
+	}
+	if d.TopGUID != top || len(c) != 3 || c[2].File != "root.hdd" {
+		t.Errorf("bad chain: top %s, %+v", d.TopGUID, c)
+	}
+	if !d.Snapshot(temp).Temporary || d.Snapshot(top).Temporary {
+		t.Errorf("bad temporary flags")
+	}
+}
+
+func TestChain(t *testing.T) {
+	d := parse(t)
+
+	c, err := d.Chain("")
+	if err != nil {
+		t.Fatalf("Chain: %s", err)
+	}
+	if len(c) != 2 || c[0].GUID != topGUID || c[1].GUID != baseGUID {
+		t.Errorf("bad chain: %+v", c)
+	}
+
+	// make a loop
+	d.Snapshot(baseGUID).ParentGUID = topGUID
+	if _, err = d.Chain(""); err == nil {
+		t.Errorf("Chain: expected an error on a loop")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	breakers := map[string]func(d *Descriptor){
+		"no size":       func(d *Descriptor) { d.Size = 0 },
+		"bad blocksize": func(d *Descriptor) { d.BlockSize = 2047 },
+		"bad top":       func(d *Descriptor) { d.TopGUID = "{}" },
+		"bad parent":    func(d *Descriptor) { d.Snapshots[1].ParentGUID = "{}" },
+		"dup guid":      func(d *Descriptor) { d.Images[1].GUID = baseGUID },
+		"no file":       func(d *Descriptor) { d.Images[0].File = "" },
+		"bad type":      func(d *Descriptor) { d.Images[0].Type = "Fancy" },
+		"two bases":     func(d *Descriptor) { d.Snapshots[1].ParentGUID = NoneUUID },
+	}
+
+	for name, fn := range breakers {
+		d := parse(t)
+		fn(d)
+		if err := d.Validate(); err == nil {
+			t.Errorf("%s: expected Validate to fail", name)
+		}
+	}
+}
+
+func TestAddRemoveDelta(t *testing.T) {
+	d := parse(t)
+	const guid = "{9d3a0c36-8e2b-4ac0-b1f1-1b0e6f1c4a5d}"
+
+	if err := d.AddDelta(guid, "root.hdd.new"); err != nil {
+		t.Fatalf("AddDelta: %s", err)
+	}
+	if err := d.AddDelta(guid, "root.hdd.new"); err == nil {
+		t.Errorf("AddDelta: expected an error on a duplicate")
+	}
+	if d.TopGUID != guid || d.Snapshot(guid).ParentGUID != topGUID {
+		t.Errorf("AddDelta: bad top or parent")
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+
+	// remove the middle one
+	if err := d.RemoveDelta(topGUID); err != nil {
+		t.Fatalf("RemoveDelta: %s", err)
+	}
+	if d.Snapshot(guid).ParentGUID != baseGUID {
+		t.Errorf("RemoveDelta: child not re-parented")
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	d := parse(t)
+
+	if err := d.Save(dir); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("Save: temporary file left behind")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != sample {
+		t.Errorf("saved file differs from original")
+	}
+
+	l, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if l.ImagePath(l.Top()) != filepath.Join(dir, "root.hdd."+topGUID) {
+		t.Errorf("bad image path %s", l.ImagePath(l.Top()))
+	}
+
+	// invalid descriptor should not be saved
+	l.TopGUID = ""
+	if err = l.Save(dir); err == nil {
+		t.Errorf("Save: expected an error for an invalid descriptor")
+	}
+}
+
+func TestNew(t *testing.T) {
+	d := New(2048*1024, 2048, "root.hdd")
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	if d.TopGUID != TopDeltaGUID || d.Images[0].GUID != TopDeltaGUID {
+		t.Errorf("expected top delta GUID %s, got %+v", TopDeltaGUID, d)
+	}
+	g := NewGUID()
+	if len(g) != len(NoneUUID) || g[0] != '{' || g[15] != '4' {
+		t.Errorf("NewGUID: bad GUID %s", g)
+	}
+	if NewGUID() == g {
+		t.Errorf("NewGUID: duplicate GUID")
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	enc := strings.Replace(sample, "    <Padding>0</Padding>\n",
+		"    <Padding>0</Padding>\n    <Encryption>\n      <KeyId>key-1</KeyId>\n    </Encryption>\n", 1)
+	d, err := Read(strings.NewReader(enc))
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if d.KeyID != "key-1" {
+		t.Errorf("expected key ID key-1, got %q", d.KeyID)
+	}
+
+	var b bytes.Buffer
+	if _, err = d.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	if b.String() != enc {
+		t.Errorf("output differs from input:\n%s", b.String())
+	}
+}
+
+func TestSnapshotMeta(t *testing.T) {
+	d := parse(t)
+	s := d.Snapshot(baseGUID)
+	if s.HasMeta() {
+		t.Errorf("unexpected metadata in %+v", s)
+	}
+	s.Description = "before <upgrade> & such"
+	s.Created = time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)
+	s.Labels = map[string]string{"app": "db", "owner": `"ops"`}
+
+	var b bytes.Buffer
+	if _, err := d.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	l, err := Read(&b)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	ls := l.Snapshot(baseGUID)
+	if !reflect.DeepEqual(ls, s) {
+		t.Errorf("expected %+v, got %+v", s, ls)
+	}
+	if l.Snapshot(topGUID).HasMeta() {
+		t.Errorf("unexpected metadata in %+v", l.Snapshot(topGUID))
+	}
+}
+
+func TestSnapshotMetaBadCreated(t *testing.T) {
+	d := parse(t)
+	s := d.Snapshot(baseGUID)
+	s.Description = "base"
+	s.Created = time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)
+
+	var b bytes.Buffer
+	if _, err := d.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	x := strings.Replace(b.String(), "2026-10-17T12:30:00Z", "yesterday", 1)
+	l, err := Read(strings.NewReader(x))
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	ls := l.Snapshot(baseGUID)
+	if ls.Description != "base" || !ls.Created.IsZero() {
+		t.Errorf("expected description only, got %+v", ls)
+	}
+}
@@ -0,0 +1,78 @@
+package descriptor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// fOFDSetlk is F_OFD_SETLK, missing from package syscall. Unlike
+// traditional record locks, open file description locks are not
+// released when some other descriptor of the same file is closed
+// (as libploop does with its own lock), yet the two kinds conflict.
+const fOFDSetlk = 37
+
+// lockTimeout is how long Lock waits for a lock held by someone else
+var lockTimeout = 60 * time.Second
+
+// Lock takes the lock libploop uses to serialize changes to a disk
+// descriptor (an fcntl lock of the path.lck file), waiting for it for
+// up to a minute. If path is a directory, FileName is appended to it.
+// The returned function releases the lock.
+//
+// The lock should not be held during libploop calls made for the same
+// descriptor by the same process, as those would wait for it.
+func Lock(path string) (func(), error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, FileName)
+	}
+
+	f, err := os.OpenFile(path+".lck", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = syscall.FcntlFlock(f.Fd(), fOFDSetlk, &lk)
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			break
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("timed out waiting for %s", f.Name())
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("descriptor: can't lock: %w", err)
+	}
+
+	// closing the file releases the lock
+	return func() { f.Close() }, nil
+}
+
+// Update loads a disk descriptor from path, calls fn to modify it, and
+// saves it back, all under the descriptor lock (see Lock), so changes
+// made concurrently by libploop, or by tools using it, are not lost.
+// If fn returns an error, nothing is saved.
+func Update(path string, fn func(d *Descriptor) error) error {
+	unlock, err := Lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err = fn(d); err != nil {
+		return err
+	}
+
+	return d.Save(path)
+}
@@ -0,0 +1,40 @@
+package descriptor
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	if err := New(1<<21, 2048, "root.hdd").Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := Lock(dir)
+	if err != nil {
+		t.Fatalf("Lock: %s", err)
+	}
+	defer func(t time.Duration) { lockTimeout = t }(lockTimeout)
+	lockTimeout = 300 * time.Millisecond
+	if _, err = Lock(filepath.Join(dir, FileName)); err == nil {
+		t.Errorf("Lock: expected an error while locked")
+	}
+	unlock()
+
+	err = Update(dir, func(d *Descriptor) error {
+		d.Snapshots[0].Description = "base"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	d, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Snapshots[0].Description != "base" {
+		t.Errorf("Update: change is not saved")
+	}
+}
@@ -0,0 +1,111 @@
+package format
+
+import "fmt"
+
+// ProblemKind is a type of an image inconsistency found by Check
+type ProblemKind int
+
+// Possible ProblemKind values
+const (
+	// InUse means the image in-use flag is set, i.e. the image
+	// was not closed cleanly (or is currently in use)
+	InUse ProblemKind = iota + 1
+	// SizeMismatch means disk size in the header does not match the
+	// number of BAT entries, or the image file size is not aligned
+	// to a cluster boundary
+	SizeMismatch
+	// OutOfRange means a BAT entry points outside of the data area
+	// of the image file
+	OutOfRange
+	// Misaligned means a BAT entry does not point to a cluster boundary
+	Misaligned
+	// Duplicate means a BAT entry points to the same image cluster
+	// as some other BAT entry
+	Duplicate
+)
+
+// String returns a short name of a problem kind
+func (k ProblemKind) String() string {
+	switch k {
+	case InUse:
+		return "in-use"
+	case SizeMismatch:
+		return "size-mismatch"
+	case OutOfRange:
+		return "out-of-range"
+	case Misaligned:
+		return "misaligned"
+	case Duplicate:
+		return "duplicate"
+	}
+	return "<unknown>"
+}
+
+// Problem describes an image inconsistency found by Check
+type Problem struct {
+	Kind    ProblemKind
+	Cluster uint32 // virtual cluster (BAT index), for BAT problems
+	Entry   uint32 // raw BAT entry value, for BAT problems
+	Other   uint32 // the other virtual cluster, for Duplicate
+	Detail  string // human readable description
+}
+
+// String returns a human readable description of a problem
+func (p Problem) String() string {
+	return p.Kind.String() + ": " + p.Detail
+}
+
+// Check performs a read-only consistency check of the image,
+// returning a list of problems found (nil if the image is fine)
+func (i *Image) Check() ([]Problem, error) {
+	var ret []Problem
+
+	if i.InUse() {
+		ret = append(ret, Problem{Kind: InUse, Detail: "image in-use flag is set"})
+	}
+
+	cs := uint64(i.ClusterSize)
+	if need := (i.DiskSize + cs - 1) / cs; need != uint64(i.Clusters) {
+		ret = append(ret, Problem{Kind: SizeMismatch,
+			Detail: fmt.Sprintf("disk size %d sectors needs %d clusters, BAT has %d entries",
+				i.DiskSize, need, i.Clusters)})
+	}
+
+	fi, err := i.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	start := int64(i.FirstBlockOffset) * SectorSize
+	if size > start && (size-start)%i.ClusterBytes() != 0 {
+		ret = append(ret, Problem{Kind: SizeMismatch,
+			Detail: fmt.Sprintf("image file size %d is not cluster aligned", size)})
+	}
+
+	seen := make(map[uint32]uint32) // BAT entry -> virtual cluster
+	for n, e := range i.bat {
+		if e == 0 {
+			continue
+		}
+		c := uint32(n)
+		if i.Version == V1 && e%i.ClusterSize != 0 {
+			ret = append(ret, Problem{Kind: Misaligned, Cluster: c, Entry: e,
+				Detail: fmt.Sprintf("cluster %d: BAT entry %d is not cluster aligned", c, e)})
+			continue
+		}
+		off := i.entryToOffset(e)
+		if off < start || off+i.ClusterBytes() > size {
+			ret = append(ret, Problem{Kind: OutOfRange, Cluster: c, Entry: e,
+				Detail: fmt.Sprintf("cluster %d: BAT entry %d points outside of data area", c, e)})
+			continue
+		}
+		if o, ok := seen[e]; ok {
+			ret = append(ret, Problem{Kind: Duplicate, Cluster: c, Entry: e, Other: o,
+				Detail: fmt.Sprintf("cluster %d: BAT entry %d is the same as for cluster %d", c, e, o)})
+			continue
+		}
+		seen[e] = c
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,52 @@
+package format
+
+import "testing"
+
+func check(t *testing.T, file string) []Problem {
+	i, err := Open(file)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer i.Close()
+
+	p, err := i.Check()
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	return p
+}
+
+func TestCheckClean(t *testing.T) {
+	for _, v := range []int{V1, V2} {
+		if p := check(t, mkimage(t, v)); p != nil {
+			t.Errorf("v%d: unexpected problems: %v", v, p)
+		}
+	}
+}
+
+func TestCheckProblems(t *testing.T) {
+	// entry 3 duplicates entry 1, entries 4 and 6 point beyond EOF
+	bat := map[int]uint32{1: 1, 3: 1, 4: 10, 6: 0x10000000}
+	p := check(t, mkimageBAT(t, V2, bat, InUseSig))
+
+	want := []struct {
+		kind    ProblemKind
+		cluster uint32
+	}{
+		{InUse, 0},
+		{Duplicate, 3},
+		{OutOfRange, 4},
+		{OutOfRange, 6},
+	}
+	if len(p) != len(want) {
+		t.Fatalf("expected %d problems, got %v", len(want), p)
+	}
+	for n, w := range want {
+		if p[n].Kind != w.kind || p[n].Cluster != w.cluster {
+			t.Errorf("problem %d: expected %s for cluster %d, got %s", n, w.kind, w.cluster, p[n])
+		}
+	}
+	if p[1].Other != 1 {
+		t.Errorf("duplicate: expected other cluster 1, got %d", p[1].Other)
+	}
+}
@@ -0,0 +1,269 @@
+// Package format reads ploop1 delta images directly, without the need
+// for libploop, cgo, or a ploop-enabled kernel.
+//
+// A ploop1 image starts with a 64-byte header, immediately followed by
+// the Block Allocation Table (BAT), an array of 32-bit little-endian
+// entries, one per virtual cluster. A zero entry means the cluster is
+// not allocated in this delta, otherwise it points to the cluster
+// location inside the image file. Data clusters start at the offset
+// set in the header (FirstBlockOffset).
+package format
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SectorSize is the size of a sector, in bytes. Most of the sizes in
+// ploop image format are expressed in sectors.
+const SectorSize = 512
+
+// HeaderSize is the size of on-disk ploop1 image header, in bytes
+const HeaderSize = 64
+
+// Image signatures, for format version 1 and 2
+const (
+	SigV1 = "WithoutFreeSpace"
+	SigV2 = "WithouFreSpacExt"
+)
+
+// Possible Header.Version values
+const (
+	V1 = 1 // BAT entries are in sectors, disk size is limited to 2T
+	V2 = 2 // BAT entries are in clusters
+)
+
+// TypeCompressed is the only valid value for Header.Type
+const TypeCompressed = 2
+
+// InUseSig is the value of DiskInUse header field when
+// an image is in use (opened by ploop kernel driver)
+const InUseSig = 0x746F6E59
+
+// ErrBadSignature is returned when a file is not a ploop1 image
+var ErrBadSignature = errors.New("format: not a ploop image (bad signature)")
+
+// Header is a decoded ploop1 image header
+type Header struct {
+	Version          int    // format version (V1 or V2)
+	Type             uint32 // disk type, should be TypeCompressed
+	Heads            uint32 // disk geometry: heads
+	Cylinders        uint32 // disk geometry: cylinders
+	ClusterSize      uint32 // cluster size, in sectors
+	Clusters         uint32 // disk size, in clusters (i.e. number of BAT entries)
+	DiskSize         uint64 // disk size, in sectors
+	DiskInUse        uint32 // InUseSig if image is in use, 0 otherwise
+	FirstBlockOffset uint32 // offset of the first data cluster, in sectors
+	Flags            uint32 // misc flags
+}
+
+// InUse returns true if the image in-use flag is set
+func (h *Header) InUse() bool {
+	return h.DiskInUse == InUseSig
+}
+
+// ClusterBytes returns the cluster size in bytes
+func (h *Header) ClusterBytes() int64 {
+	return int64(h.ClusterSize) * SectorSize
+}
+
+// UnmarshalBinary decodes a header from its on-disk form
+func (h *Header) UnmarshalBinary(b []byte) error {
+	if len(b) < HeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	le := binary.LittleEndian
+
+	switch string(b[0:16]) {
+	case SigV1:
+		h.Version = V1
+		h.DiskSize = uint64(le.Uint32(b[36:]))
+	case SigV2:
+		h.Version = V2
+		h.DiskSize = le.Uint64(b[36:])
+	default:
+		return ErrBadSignature
+	}
+	h.Type = le.Uint32(b[16:])
+	h.Heads = le.Uint32(b[20:])
+	h.Cylinders = le.Uint32(b[24:])
+	h.ClusterSize = le.Uint32(b[28:])
+	h.Clusters = le.Uint32(b[32:])
+	h.DiskInUse = le.Uint32(b[44:])
+	h.FirstBlockOffset = le.Uint32(b[48:])
+	h.Flags = le.Uint32(b[52:])
+
+	return nil
+}
+
+// MarshalBinary encodes a header to its on-disk form
+func (h *Header) MarshalBinary() ([]byte, error) {
+	b := make([]byte, HeaderSize)
+	le := binary.LittleEndian
+
+	switch h.Version {
+	case V1:
+		if h.DiskSize > 0xffffffff {
+			return nil, fmt.Errorf("format: disk size %d is too big for version 1", h.DiskSize)
+		}
+		copy(b, SigV1)
+		le.PutUint32(b[36:], uint32(h.DiskSize))
+	case V2:
+		copy(b, SigV2)
+		le.PutUint64(b[36:], h.DiskSize)
+	default:
+		return nil, fmt.Errorf("format: unknown version %d", h.Version)
+	}
+	le.PutUint32(b[16:], h.Type)
+	le.PutUint32(b[20:], h.Heads)
+	le.PutUint32(b[24:], h.Cylinders)
+	le.PutUint32(b[28:], h.ClusterSize)
+	le.PutUint32(b[32:], h.Clusters)
+	le.PutUint32(b[44:], h.DiskInUse)
+	le.PutUint32(b[48:], h.FirstBlockOffset)
+	le.PutUint32(b[52:], h.Flags)
+
+	return b, nil
+}
+
+// Validate checks the header fields for sanity
+func (h *Header) Validate() error {
+	if h.Type != TypeCompressed {
+		return fmt.Errorf("format: unsupported disk type %d", h.Type)
+	}
+	if h.ClusterSize == 0 || h.ClusterSize&(h.ClusterSize-1) != 0 {
+		return fmt.Errorf("format: invalid cluster size %d", h.ClusterSize)
+	}
+	if h.FirstBlockOffset%h.ClusterSize != 0 {
+		return fmt.Errorf("format: first block offset %d is not cluster aligned", h.FirstBlockOffset)
+	}
+	if uint64(h.FirstBlockOffset)*SectorSize < HeaderSize+4*uint64(h.Clusters) {
+		return fmt.Errorf("format: first block offset %d overlaps with BAT", h.FirstBlockOffset)
+	}
+	return nil
+}
+
+// Image is an opened ploop1 delta image
+type Image struct {
+	Header
+	f   *os.File
+	bat []uint32
+}
+
+// Open opens a ploop1 delta image file read-only,
+// reading and validating its header and BAT
+func Open(file string) (*Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return i, nil
+}
+
+func newImage(f *os.File) (*Image, error) {
+	i := &Image{f: f}
+
+	b := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	if err := i.Header.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	if err := i.Header.Validate(); err != nil {
+		return nil, err
+	}
+
+	b = make([]byte, 4*int64(i.Clusters))
+	if _, err := f.ReadAt(b, HeaderSize); err != nil {
+		return nil, fmt.Errorf("format: can't read BAT: %w", err)
+	}
+	i.bat = make([]uint32, i.Clusters)
+	for n := range i.bat {
+		i.bat[n] = binary.LittleEndian.Uint32(b[4*n:])
+	}
+
+	return i, nil
+}
+
+// Close closes the image file
+func (i *Image) Close() error {
+	return i.f.Close()
+}
+
+// File returns the underlying image file
+func (i *Image) File() *os.File {
+	return i.f
+}
+
+// BAT returns raw BAT entries. The returned slice
+// should not be modified by the caller.
+func (i *Image) BAT() []uint32 {
+	return i.bat
+}
+
+// entryToOffset converts a non-zero BAT entry to a byte offset
+// inside the image file, according to image format version
+func (i *Image) entryToOffset(e uint32) int64 {
+	if i.Version == V1 {
+		return int64(e) * SectorSize
+	}
+	return int64(e) * i.ClusterBytes()
+}
+
+// Offset returns the byte offset of a given virtual cluster
+// inside the image file, and whether it is allocated
+func (i *Image) Offset(cluster uint32) (int64, bool) {
+	if cluster >= uint32(len(i.bat)) || i.bat[cluster] == 0 {
+		return 0, false
+	}
+	return i.entryToOffset(i.bat[cluster]), true
+}
+
+// Allocated returns the number of allocated clusters
+func (i *Image) Allocated() int {
+	n := 0
+	for _, e := range i.bat {
+		if e != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Walk calls fn for every allocated cluster, in virtual cluster order,
+// passing the virtual cluster number and its byte offset inside the
+// image file. If fn returns an error, Walk stops and returns it.
+func (i *Image) Walk(fn func(cluster uint32, offset int64) error) error {
+	for n, e := range i.bat {
+		if e == 0 {
+			continue
+		}
+		if err := fn(uint32(n), i.entryToOffset(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadCluster reads the data of a given virtual cluster into b,
+// which should be at least ClusterBytes() long. It returns false
+// (and leaves b untouched) if the cluster is not allocated.
+func (i *Image) ReadCluster(cluster uint32, b []byte) (bool, error) {
+	off, ok := i.Offset(cluster)
+	if !ok {
+		return false, nil
+	}
+	_, err := i.f.ReadAt(b[:i.ClusterBytes()], off)
+	return true, err
+}
@@ -0,0 +1,159 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mkimage writes a small ploop1 image with 8 clusters of 1 sector
+// each, with virtual clusters 1 and 5 allocated
+func mkimage(t *testing.T, version int) string {
+	// cluster 1 is the first data cluster, cluster 5 is the second one
+	// (in both versions, as cluster size is equal to sector size)
+	return mkimageBAT(t, version, map[int]uint32{1: 1, 5: 2}, 0)
+}
+
+// mkimageBAT writes a small ploop1 image with 8 clusters of 1 sector
+// each, a given BAT, two data clusters, and a given in-use flag value
+func mkimageBAT(t *testing.T, version int, entries map[int]uint32, inUse uint32) string {
+	h := Header{
+		Version:          version,
+		Type:             TypeCompressed,
+		Heads:            16,
+		Cylinders:        1,
+		ClusterSize:      1,
+		Clusters:         8,
+		DiskSize:         8,
+		DiskInUse:        inUse,
+		FirstBlockOffset: 1,
+	}
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %s", err)
+	}
+
+	bat := make([]byte, SectorSize-HeaderSize)
+	for n, e := range entries {
+		binary.LittleEndian.PutUint32(bat[4*n:], e)
+	}
+	b = append(b, bat...)
+	b = append(b, bytes.Repeat([]byte{'a'}, SectorSize)...)
+	b = append(b, bytes.Repeat([]byte{'b'}, SectorSize)...)
+
+	file := filepath.Join(t.TempDir(), "root.hdd")
+	if err = os.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestHeaderRoundtrip(t *testing.T) {
+	for _, v := range []int{V1, V2} {
+		h := Header{Version: v, Type: TypeCompressed, ClusterSize: 2048,
+			Clusters: 10, DiskSize: 20480, DiskInUse: InUseSig,
+			FirstBlockOffset: 2048, Flags: 1}
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %s", err)
+		}
+		var h2 Header
+		if err = h2.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary: %s", err)
+		}
+		if h != h2 {
+			t.Errorf("v%d: header mismatch:\n%+v\n%+v", v, h, h2)
+		}
+		if !h2.InUse() {
+			t.Errorf("v%d: in-use flag lost", v)
+		}
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	var h Header
+	b := make([]byte, HeaderSize)
+	copy(b, "NotAPloopImage!!")
+	if err := h.UnmarshalBinary(b); err != ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+}
+
+func TestV1SizeLimit(t *testing.T) {
+	h := Header{Version: V1, DiskSize: 1 << 32}
+	if _, err := h.MarshalBinary(); err == nil {
+		t.Errorf("expected an error for too big v1 disk")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, v := range []int{V1, V2} {
+		i, err := Open(mkimage(t, v))
+		if err != nil {
+			t.Fatalf("v%d: Open: %s", v, err)
+		}
+		defer i.Close()
+
+		if i.Allocated() != 2 {
+			t.Errorf("v%d: expected 2 allocated clusters, got %d", v, i.Allocated())
+		}
+
+		var got []uint32
+		err = i.Walk(func(c uint32, off int64) error {
+			got = append(got, c)
+			return nil
+		})
+		if err != nil || len(got) != 2 || got[0] != 1 || got[1] != 5 {
+			t.Errorf("v%d: Walk: bad result %v (err %v)", v, got, err)
+		}
+
+		buf := make([]byte, i.ClusterBytes())
+		if ok, err := i.ReadCluster(5, buf); !ok || err != nil || buf[0] != 'b' {
+			t.Errorf("v%d: ReadCluster(5): %v %v %q", v, ok, err, buf[0])
+		}
+		if ok, _ := i.ReadCluster(0, buf); ok {
+			t.Errorf("v%d: ReadCluster(0): expected not allocated", v)
+		}
+		if _, ok := i.Offset(100); ok {
+			t.Errorf("v%d: Offset(100): expected out of range", v)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "root.hdd")
+	w, err := Create(file, 1000, 8)
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if err = w.Write(3, bytes.Repeat([]byte{'c'}, 8*SectorSize)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err = w.Write(3, make([]byte, 8*SectorSize)); err == nil {
+		t.Errorf("Write: expected an error for a cluster written twice")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err = Create(file, 1000, 8); err == nil {
+		t.Errorf("Create: expected an error for an existing file")
+	}
+
+	if p := check(t, file); p != nil {
+		t.Errorf("unexpected problems: %v", p)
+	}
+	i, err := Open(file)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer i.Close()
+	if i.Version != V2 || i.DiskSize != 1000 || i.Clusters != 125 || i.Allocated() != 1 {
+		t.Errorf("bad header %+v", i.Header)
+	}
+	buf := make([]byte, i.ClusterBytes())
+	if ok, err := i.ReadCluster(3, buf); !ok || err != nil || buf[0] != 'c' {
+		t.Errorf("ReadCluster(3): %v %v %q", ok, err, buf[0])
+	}
+}
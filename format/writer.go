@@ -0,0 +1,103 @@
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Writer creates a new ploop1 image (format version 2), appending
+// data clusters to the file one by one. The header and the BAT are
+// written on Close, so an image that was not closed properly is not
+// a valid ploop image.
+type Writer struct {
+	Header
+	f    *os.File
+	bat  []uint32
+	next uint32 // next free cluster in the image file
+}
+
+// NewHeader returns a header for a new empty image of a given size
+// (in sectors) and cluster size (in sectors), with a default geometry
+func NewHeader(size uint64, clusterSize uint32) Header {
+	clusters := uint32((size + uint64(clusterSize) - 1) / uint64(clusterSize))
+	cb := uint64(clusterSize) * SectorSize
+	batClusters := (HeaderSize + 4*uint64(clusters) + cb - 1) / cb
+
+	return Header{
+		Version:          V2,
+		Type:             TypeCompressed,
+		Heads:            16,
+		Cylinders:        uint32(size / (16 * 63)),
+		ClusterSize:      clusterSize,
+		Clusters:         clusters,
+		DiskSize:         size,
+		FirstBlockOffset: uint32(batClusters) * clusterSize,
+	}
+}
+
+// Create creates a new image file (which must not exist) of a given
+// size and cluster size (both in sectors), to be filled with Write
+func Create(file string, size uint64, clusterSize uint32) (*Writer, error) {
+	w := &Writer{Header: NewHeader(size, clusterSize)}
+	if err := w.Header.Validate(); err != nil {
+		return nil, err
+	}
+	w.bat = make([]uint32, w.Clusters)
+	w.next = w.FirstBlockOffset / w.ClusterSize
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w.f = f
+
+	return w, nil
+}
+
+// File returns the underlying image file
+func (w *Writer) File() *os.File {
+	return w.f
+}
+
+// Write writes the data of a given virtual cluster, which must not be
+// written before. b must be exactly ClusterBytes() long.
+func (w *Writer) Write(cluster uint32, b []byte) error {
+	if cluster >= w.Clusters {
+		return fmt.Errorf("format: cluster %d is out of range", cluster)
+	}
+	if w.bat[cluster] != 0 {
+		return fmt.Errorf("format: cluster %d is already written", cluster)
+	}
+	if int64(len(b)) != w.ClusterBytes() {
+		return fmt.Errorf("format: bad cluster data length %d", len(b))
+	}
+	if _, err := w.f.WriteAt(b, int64(w.next)*w.ClusterBytes()); err != nil {
+		return err
+	}
+	w.bat[cluster] = w.next
+	w.next++
+
+	return nil
+}
+
+// Close writes the header and the BAT, syncs and closes the image file
+func (w *Writer) Close() error {
+	b, err := w.Header.MarshalBinary()
+	if err == nil {
+		bat := make([]byte, int64(w.FirstBlockOffset)*SectorSize-HeaderSize)
+		for n, e := range w.bat {
+			binary.LittleEndian.PutUint32(bat[4*n:], e)
+		}
+		b = append(b, bat...)
+		_, err = w.f.WriteAt(b, 0)
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
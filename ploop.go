@@ -1,8 +1,16 @@
 package ploop
 
-import "strings"
+import "context"
+import "fmt"
+import "os"
 import "os/exec"
+import "path/filepath"
+import "runtime"
 import "sync"
+import "syscall"
+import "time"
+
+import "github.com/kolyshkin/goploop/descriptor"
 
 // #include <ploop/libploop.h>
 import "C"
@@ -24,9 +32,9 @@ func SetLogFile(file string) error {
 	cfile := C.CString(file)
 	defer cfree(cfile)
 
-	ret := C.ploop_set_log_file(cfile)
-
-	return mkerr(ret)
+	return call(func() C.int {
+		return C.ploop_set_log_file(cfile)
+	})
 }
 
 // SetLogLevel sets a level of verbosity when logging to a file
@@ -34,9 +42,76 @@ func SetLogLevel(v int) {
 	C.ploop_set_log_level(C.int(v))
 }
 
-// Ploop is a type containing DiskDescriptor.xml opened by the library
+// cDisk is a libploop opened disk descriptor
+type cDisk = C.struct_ploop_disk_images_data
+
+// handle is shared between all copies of a Ploop value
+type handle struct {
+	sync.Mutex
+	d    *cDisk // nil after Close
+	file string // DiskDescriptor.xml, as passed to Open
+}
+
+// Ploop is a type containing DiskDescriptor.xml opened by the library.
+// It is safe for concurrent use by multiple goroutines; all operations
+// on the same Ploop (or its copies) are serialized.
 type Ploop struct {
-	d *C.struct_ploop_disk_images_data
+	h   *handle
+	ctx context.Context // set by runContext, checked by do
+}
+
+// do runs fn with the opened disk descriptor. Operations on the same
+// descriptor are serialized, and the calling goroutine is locked to its
+// OS thread for the duration of fn, so that libploop's last error string
+// fetched by mkerr() belongs to the call made by fn.
+// If the descriptor is closed (or was never opened), ErrClosed is returned.
+// If d is bound to a context by runContext which is done by the time the
+// descriptor lock is acquired, fn is not run, and E_ABORT is returned.
+func (d Ploop) do(fn func(di *cDisk) error) error {
+	if d.h == nil {
+		return ErrClosed
+	}
+	d.h.Lock()
+	defer d.h.Unlock()
+	if err := d.aborted(); err != nil {
+		return err
+	}
+	if d.h.d == nil {
+		return ErrClosed
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	return fn(d.h.d)
+}
+
+// call is the same as do, but fn returns libploop return code
+func (d Ploop) call(fn func(di *cDisk) C.int) error {
+	return d.do(func(di *cDisk) error {
+		return mkerr(fn(di))
+	})
+}
+
+// doMeta is the same as do, but also preserves snapshot metadata in
+// DiskDescriptor.xml, which libploop drops when it rewrites the file
+// (see ploop_meta.go). fn can add metadata of new snapshots to m.
+func (d Ploop) doMeta(fn func(di *cDisk, m snapMeta) error) error {
+	return d.do(func(di *cDisk) error {
+		m := loadMeta(d.h.file)
+		err := fn(di, m)
+		if merr := m.restore(d.h.file); err == nil {
+			err = merr
+		}
+		return err
+	})
+}
+
+// callMeta is the same as call, but preserves snapshot metadata, see doMeta
+func (d Ploop) callMeta(fn func(di *cDisk) C.int) error {
+	return d.doMeta(func(di *cDisk, _ snapMeta) error {
+		return mkerr(fn(di))
+	})
 }
 
 var once sync.Once
@@ -52,75 +127,69 @@ func loadKmod() {
 
 // Open opens a ploop DiskDescriptor.xml, most ploop operations require it
 func Open(file string) (Ploop, error) {
-	var d Ploop
+	var di *cDisk
 
 	once.Do(loadKmod)
 
+	// the descriptor is also read by this package, possibly
+	// after the current directory is changed
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return Ploop{}, &Err{c: E_PARAM, s: err.Error()}
+	}
 	cfile := C.CString(file)
 	defer cfree(cfile)
 
-	ret := C.ploop_open_dd(&d.d, cfile)
+	err = call(func() C.int {
+		return C.ploop_open_dd(&di, cfile)
+	})
+	if err != nil {
+		return Ploop{}, err
+	}
 
-	return d, mkerr(ret)
+	return Ploop{h: &handle{d: di, file: file}}, nil
 }
 
-// Close closes a ploop disk descriptor when it is no longer needed
+// Close closes a ploop disk descriptor when it is no longer needed.
+// It is safe to call Close more than once; any operation on a closed
+// descriptor returns ErrClosed.
 func (d Ploop) Close() {
-	C.ploop_close_dd(d.d)
+	if d.h == nil {
+		return
+	}
+	d.h.Lock()
+	defer d.h.Unlock()
+
+	if d.h.d != nil {
+		C.ploop_close_dd(d.h.d)
+		d.h.d = nil
+	}
 }
 
-// ImageMode is a type for CreateParam.Mode field
-type ImageMode int
+// LibBackend is the default Backend implementation, using libploop
+type LibBackend struct{}
 
-// Possible values for ImageMode
-const (
-	Expanded     ImageMode = C.PLOOP_EXPANDED_MODE
-	Preallocated ImageMode = C.PLOOP_EXPANDED_PREALLOCATED_MODE
-	Raw          ImageMode = C.PLOOP_RAW_MODE
-)
+// Make sure LibBackend and Ploop implement the interfaces
+var _ Backend = LibBackend{}
+var _ Disk = Ploop{}
 
-// ParseImageMode converts a string to ImageMode value
-func ParseImageMode(s string) (ImageMode, error) {
-	switch strings.ToLower(s) {
-	case "expanded":
-		return Expanded, nil
-	case "preallocated":
-		return Preallocated, nil
-	case "raw":
-		return Raw, nil
-	default:
-		return Expanded, mkerr(E_PARAM)
-	}
+// Create calls Create()
+func (LibBackend) Create(p *CreateParam) error {
+	return Create(p)
 }
 
-// String converts an ImageMode value to string
-func (m ImageMode) String() string {
-	switch m {
-	case Expanded:
-		return "Expanded"
-	case Preallocated:
-		return "Preallocated"
-	case Raw:
-		return "Raw"
+// Open calls Open()
+func (LibBackend) Open(file string) (Disk, error) {
+	d, err := Open(file)
+	if err != nil {
+		return nil, err
 	}
-	return "<unknown>"
+	return d, nil
 }
 
-// CreateFlags is a type for CreateParam.Flags
-type CreateFlags uint
-
-// Possible values for CreateFlags
-const (
-	NoLazy CreateFlags = C.PLOOP_CREATE_NOLAZY
-)
-
-// CreateParam is a set of parameters for a newly created ploop
-type CreateParam struct {
-	Size  uint64      // image size, in kilobytes (FS size is about 10% smaller)
-	Mode  ImageMode   // image mode
-	File  string      // path to and a file name for base delta image
-	CLog  uint        // cluster block size log (6 to 15, default 11)
-	Flags CreateFlags // flags
+// FSInfo calls FSInfo()
+func (LibBackend) FSInfo(file string) (FSInfoData, error) {
+	return FSInfo(file)
 }
 
 // Create creates a ploop image and its DiskDescriptor.xml
@@ -131,7 +200,7 @@ func Create(p *CreateParam) error {
 
 	// default image file name
 	if p.File == "" {
-		p.File = "root.hdd"
+		p.File = DefaultFile
 	}
 
 	a.size = convertSize(p.Size)
@@ -145,38 +214,150 @@ func Create(p *CreateParam) error {
 	a.flags = C.uint(p.Flags)
 	a.image = C.CString(p.File)
 	defer cfree(a.image)
-	a.fstype = C.CString("ext4")
-	defer cfree(a.fstype)
+	a.without_partition = boolToC(p.NoPartition)
 
-	ret := C.ploop_create_image(&a)
-	return mkerr(ret)
+	if p.KeyID != "" {
+		a.keyid = C.CString(p.KeyID)
+		defer cfree(a.keyid)
+	}
+
+	fstype := p.FSType
+	if fstype == "" {
+		fstype = DefaultFSType
+	}
+	// libploop can only create ext4 with default options,
+	// for anything else, we run mkfs ourselves
+	ownMkfs := !p.NoFS && (fstype != DefaultFSType || p.InodeRatio != 0 || len(p.MkfsOptions) != 0)
+	if p.KeyID == "" && (p.Keys != nil || p.Cipher != "") {
+		return &Err{c: E_PARAM, s: "key ID is not set"}
+	}
+	if ownMkfs && p.KeyID != "" {
+		// the file system type of an encrypted image can't be
+		// detected, so it should be the one libploop can mount
+		return &Err{c: E_PARAM, s: "encrypted images can only have the default file system"}
+	}
+	if ownMkfs {
+		// the partition (if any) is created by mkfs
+		a.without_partition = 1
+	}
+	if !p.NoFS && !ownMkfs {
+		a.fstype = C.CString(fstype)
+		defer cfree(a.fstype)
+		if p.FSLabel != "" {
+			a.fslabel = C.CString(p.FSLabel)
+			defer cfree(a.fslabel)
+		}
+	}
+
+	err := withKeys(p.Keys, p.Cipher, []string{p.KeyID}, func() error {
+		return call(func() C.int {
+			return C.ploop_create_image(&a)
+		})
+	})
+	if err != nil || !ownMkfs {
+		return err
+	}
+
+	dd := filepath.Join(filepath.Dir(p.File), descriptor.FileName)
+	if err = mkfs(dd, p, fstype); err != nil {
+		os.Remove(p.File)
+		os.Remove(dd)
+	}
+	return err
 }
 
-// MountParam is a set of parameters to pass to Mount()
-type MountParam struct {
-	UUID     string // snapshot uuid (empty for top delta)
-	Target   string // mount point (empty if no mount is needed)
-	Flags    int    // bit mount flags such as MS_NOATIME
-	Data     string // auxiliary mount options
-	Readonly bool   // mount read-only
-	Fsck     bool   // do fsck before mounting inner FS
-	Quota    bool   // enable quota for inner FS
+// mkfs creates an inner file system of a given type on a newly
+// created ploop image, by running mkfs.<fstype>
+func mkfs(dd string, p *CreateParam, fstype string) error {
+	d, err := Open(dd)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	r, err := d.MountExtended(&MountParam{})
+	if err != nil {
+		return err
+	}
+	defer d.Umount()
+
+	// the image is created without a partition (see Create),
+	// so make one the way libploop does, and wait for its device
+	dev := r.Device
+	if !p.NoPartition {
+		out, err := exec.Command("parted", "-s", dev, "mklabel", "gpt", "mkpart", "primary", "1MiB", "100%").CombinedOutput()
+		if err != nil {
+			return &Err{c: E_MKFS, s: fmt.Sprintf("parted %s: %s: %s", dev, err, out)}
+		}
+		dev += "p1"
+		if err = waitDevice(dev, 10*time.Second); err != nil {
+			return err
+		}
+	}
+
+	args, err := mkfsArgs(p, fstype, dev)
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("mkfs."+fstype, args...).CombinedOutput(); err != nil {
+		return &Err{c: E_MKFS, s: fmt.Sprintf("mkfs.%s: %s: %s", fstype, err, out)}
+	}
+
+	return nil
 }
 
 // Mount creates a ploop device and (optionally) mounts it
 func (d Ploop) Mount(p *MountParam) (string, error) {
+	return d.MountContext(context.Background(), p)
+}
+
+// MountContext is the same as Mount, but can be cancelled via ctx,
+// which is useful if fsck is requested. See runContext for details.
+func (d Ploop) MountContext(ctx context.Context, p *MountParam) (string, error) {
+	r, err := d.MountExtendedContext(ctx, p)
+	return r.Device, err
+}
+
+// MountExtended is the same as Mount, but returns more details
+// about the mount, including the fsck result.
+func (d Ploop) MountExtended(p *MountParam) (MountResult, error) {
+	return d.MountExtendedContext(context.Background(), p)
+}
+
+// MountExtendedContext is the same as MountExtended, but can be
+// cancelled via ctx. See runContext for details.
+func (d Ploop) MountExtendedContext(ctx context.Context, p *MountParam) (MountResult, error) {
 	var a C.struct_ploop_mount_param
-	var device string
+	var r MountResult
+
+	// libploop can only mount ext file systems, others are mounted here
+	fstype := p.FSType
+	if fstype == FSTypeAuto {
+		fstype = ""
+		if p.Target != "" && d.h != nil {
+			// on failure, let libploop try
+			fstype, _ = imageFSType(d.h.file, p.UUID)
+		}
+	}
+	ownMount := p.Target != "" && fstype != "" && !isExt(fstype)
+	if ownMount && (p.Fsck || p.Quota) {
+		return r, &Err{c: E_PARAM, s: "fsck and quota are only supported for ext file systems, not " + fstype}
+	}
 
 	if p.UUID != "" {
 		a.guid = C.CString(p.UUID)
 		defer cfree(a.guid)
 	}
-	if p.Target != "" {
+	if p.Target != "" && !ownMount {
 		a.target = C.CString(p.Target)
 		defer cfree(a.target)
 	}
 
+	if p.Component != "" {
+		a.component_name = C.CString(p.Component)
+		defer cfree(a.component_name)
+	}
+
 	// mount_data should not be NULL
 	a.mount_data = C.CString(p.Data)
 	defer cfree(a.mount_data)
@@ -186,19 +367,91 @@ func (d Ploop) Mount(p *MountParam) (string, error) {
 	a.fsck = boolToC(p.Fsck)
 	a.quota = boolToC(p.Quota)
 
-	ret := C.ploop_mount_image(d.d, &a)
-	if ret == 0 {
-		device = C.GoString(&a.device[0])
-		// TODO? fsck_code = C.GoString(a.fsck_rc)
+	keys, id := p.Keys, ""
+	if keys != nil {
+		var err error
+		if id, err = d.KeyID(); err != nil {
+			return r, err
+		}
+		if id == "" {
+			// not encrypted
+			keys = nil
+		}
 	}
-	return device, mkerr(ret)
+
+	err := withKeys(keys, "", []string{id}, func() error {
+		return d.runContext(ctx, func(d Ploop) error {
+			return d.do(func(di *cDisk) error {
+				ret := C.ploop_mount_image(di, &a)
+				// fsck result is useful even if mount failed
+				r.Fsck = FsckCode(a.fsck_rc)
+				if ret != 0 {
+					return mkerr(ret)
+				}
+				r.Deltas = deltaChain(snapshots(di), p.UUID)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return r, err
+	}
+
+	r.Device = C.GoString(&a.device[0])
+	r.Partition = partitionDevice(r.Device)
+	if ownMount {
+		flags := uintptr(p.Flags)
+		if p.Readonly {
+			flags |= syscall.MS_RDONLY
+		}
+		if err = syscall.Mount(r.Partition, p.Target, fstype, flags, p.Data); err != nil {
+			UmountByDevice(r.Device)
+			return r, &Err{c: E_MOUNT, s: fmt.Sprintf("mount %s to %s: %s", r.Partition, p.Target, err)}
+		}
+	}
+	if p.Target != "" {
+		r.MountPoint = mountPoint(r.Partition)
+		if r.MountPoint == "" {
+			r.MountPoint = p.Target
+		}
+	}
+
+	return r, nil
+}
+
+// partitionDevice returns the partition device of a ploop device,
+// or the device itself if the image has no partition table
+func partitionDevice(dev string) string {
+	name := filepath.Base(dev)
+	if _, err := os.Stat(filepath.Join("/sys/block", name, name+"p1")); err == nil {
+		return dev + "p1"
+	}
+	return dev
+}
+
+// mountPoint returns the mount point of a device, or an empty string
+func mountPoint(dev string) string {
+	const len = 4096 // PATH_MAX
+	var out [len]C.char
+
+	cdev := C.CString(dev)
+	defer cfree(cdev)
+
+	err := call(func() C.int {
+		return C.ploop_get_mnt_by_dev(cdev, &out[0], len)
+	})
+	if err != nil {
+		return ""
+	}
+
+	return C.GoString(&out[0])
 }
 
 // Umount unmounts the ploop filesystem and dismantles the device
 func (d Ploop) Umount() error {
-	ret := C.ploop_umount_image(d.d)
-
-	return mkerr(ret)
+	return d.call(func(di *cDisk) C.int {
+		return C.ploop_umount_image(di)
+	})
 }
 
 // UmountByDevice unmounts the ploop filesystem and dismantles the device.
@@ -208,38 +461,74 @@ func UmountByDevice(dev string) error {
 	cdev := C.CString(dev)
 	defer cfree(cdev)
 
-	ret := C.ploop_umount(cdev, nil)
-
-	return mkerr(ret)
+	return call(func() C.int {
+		return C.ploop_umount(cdev, nil)
+	})
 }
 
 // Resize changes the ploop size. Online resize is recommended.
 func (d Ploop) Resize(size uint64, offline bool) error {
+	return d.ResizeContext(context.Background(), size, offline)
+}
+
+// ResizeContext is the same as Resize, but can be cancelled via ctx.
+// See runContext for details.
+func (d Ploop) ResizeContext(ctx context.Context, size uint64, offline bool) error {
 	var p C.struct_ploop_resize_param
 
 	p.size = convertSize(size)
 	p.offline_resize = boolToC(offline)
 
-	ret := C.ploop_resize_image(d.d, &p)
-	return mkerr(ret)
+	return d.runContext(ctx, func(d Ploop) error {
+		return d.callMeta(func(di *cDisk) C.int {
+			return C.ploop_resize_image(di, &p)
+		})
+	})
 }
 
-// Snapshot creates a ploop snapshot, returning its uuid
+// Snapshot creates a ploop snapshot, returning its uuid.
+// No metadata is recorded, see SnapshotExtended.
 func (d Ploop) Snapshot() (string, error) {
-	var p C.struct_ploop_snapshot_param
+	return d.snapshot(&SnapshotParam{}, false)
+}
+
+// SnapshotExtended is the same as Snapshot, but with additional
+// parameters. The creation time, and the description and labels (if
+// given) are saved in DiskDescriptor.xml, and returned by Snapshots.
+// Note that tools other than this package (such as the ploop utility
+// or vzctl) drop this metadata if they rewrite the descriptor, and it
+// can't be recovered.
+func (d Ploop) SnapshotExtended(p *SnapshotParam) (string, error) {
+	return d.snapshot(p, true)
+}
+
+// snapshot creates a snapshot, recording its metadata if meta is set
+func (d Ploop) snapshot(p *SnapshotParam, meta bool) (string, error) {
+	var a C.struct_ploop_snapshot_param
 	uuid, err := UUID()
 	if err != nil {
 		return "", err
 	}
-	p.guid = C.CString(uuid)
-	defer cfree(p.guid)
+	a.guid = C.CString(uuid)
+	defer cfree(a.guid)
+	a.temporary = boolToC(p.Temporary)
 
-	ret := C.ploop_create_snapshot(d.d, &p)
-	if ret == 0 {
-		uuid = C.GoString(p.guid)
-	}
+	err = d.doMeta(func(di *cDisk, m snapMeta) error {
+		if err := mkerr(C.ploop_create_snapshot(di, &a)); err != nil {
+			return err
+		}
+		uuid = C.GoString(a.guid)
+		if meta {
+			m[uuid] = descriptor.Snapshot{
+				Description: p.Description,
+				Created:     time.Now().UTC().Truncate(time.Second),
+				Labels:      p.Labels,
+			}
+		}
+		return nil
+	})
 
-	return uuid, mkerr(ret)
+	return uuid, err
 }
 
 // SwitchSnapshot switches to a specified snapshot,
@@ -252,29 +541,11 @@ func (d Ploop) SwitchSnapshot(uuid string) error {
 	p.guid = C.CString(uuid)
 	defer cfree(p.guid)
 
-	ret := C.ploop_switch_snapshot_ex(d.d, &p)
-
-	return mkerr(ret)
+	return d.callMeta(func(di *cDisk) C.int {
+		return C.ploop_switch_snapshot_ex(di, &p)
+	})
 }
 
-// SwitchFlag is a type for SwitchSnapshotExtended.Flags
-type SwitchFlag uint
-
-const (
-	// SkipDestroy flag, if set, modifies the behavior of
-	// SwitchSnapshotExtended to not delete the old top delta, but
-	// make it a snapshot and return its uuid. Without this flag,
-	// old top delta (i.e. data modified since the last snapshot)
-	// is lost.
-	SkipDestroy SwitchFlag = C.PLOOP_SNAP_SKIP_TOPDELTA_DESTROY
-	// SkipCreate flag, if set, modifies the behavior of
-	// SwitchSnapshotExtended to not create a new top delta,
-	// but rather transform the specified snapshot itself to be
-	// the new top delta), so all new changes will be written
-	// right to it. Snapshot UUID is lost in this case.
-	SkipCreate SwitchFlag = C.PLOOP_SNAP_SKIP_TOPDELTA_CREATE
-)
-
 // SwitchSnapshotExtended is same as SwitchSnapshot but with additional
 // flags modifying its behavior. Please see individual flags description.
 // Returns uuid of what was the old top delta if SkipDestroy flag is set.
@@ -296,45 +567,39 @@ func (d Ploop) SwitchSnapshotExtended(uuid string, flags SwitchFlag) (string, er
 		defer cfree(p.guid_old)
 	}
 
-	ret := C.ploop_switch_snapshot_ex(d.d, &p)
+	err := d.callMeta(func(di *cDisk) C.int {
+		return C.ploop_switch_snapshot_ex(di, &p)
+	})
 
-	return oldUUID, mkerr(ret)
+	return oldUUID, err
 }
 
 // DeleteSnapshot deletes a snapshot (merging it down if necessary)
 func (d Ploop) DeleteSnapshot(uuid string) error {
-	cuuid := C.CString(uuid)
-	defer cfree(cuuid)
-
-	ret := C.ploop_delete_snapshot(d.d, cuuid)
-
-	return mkerr(ret)
+	return d.DeleteSnapshotContext(context.Background(), uuid)
 }
 
-// ReplaceFlag is a type for ReplaceParam.Flags field
-type ReplaceFlag int
-
-// Possible values for ReplaceParam.Flags field
-const (
-	// KeepName renames the new file to old file name after replace;
-	// note that if this option is used the old file is removed.
-	KeepName ReplaceFlag = C.PLOOP_REPLACE_KEEP_NAME
-)
+// DeleteSnapshotContext is the same as DeleteSnapshot, but can be
+// cancelled via ctx, aborting the merge. See runContext for details.
+func (d Ploop) DeleteSnapshotContext(ctx context.Context, uuid string) error {
+	cuuid := C.CString(uuid)
+	defer cfree(cuuid)
 
-// ReplaceParam is a set of parameters to Replace()
-type ReplaceParam struct {
-	File string // new image file name
-	// Image to be replaced is specified by either
-	// uuid, current file name, or level,
-	// in the above order of preference.
-	UUID    string
-	CurFile string
-	Level   int
-	Flags   ReplaceFlag
+	return d.runContext(ctx, func(d Ploop) error {
+		return d.callMeta(func(di *cDisk) C.int {
+			return C.ploop_delete_snapshot(di, cuuid)
+		})
+	})
 }
 
 // Replace replaces a ploop image to a different (but identical) one
 func (d Ploop) Replace(p *ReplaceParam) error {
+	return d.ReplaceContext(context.Background(), p)
+}
+
+// ReplaceContext is the same as Replace, but can be cancelled via ctx.
+// See runContext for details.
+func (d Ploop) ReplaceContext(ctx context.Context, p *ReplaceParam) error {
 	var a C.struct_ploop_replace_param
 
 	a.file = C.CString(p.File)
@@ -352,31 +617,54 @@ func (d Ploop) Replace(p *ReplaceParam) error {
 
 	a.flags = C.int(p.Flags)
 
-	ret := C.ploop_replace_image(d.d, &a)
-
-	return mkerr(ret)
+	return d.runContext(ctx, func(d Ploop) error {
+		return d.callMeta(func(di *cDisk) C.int {
+			return C.ploop_replace_image(di, &a)
+		})
+	})
 }
 
 // IsMounted returns true if ploop is mounted
 func (d Ploop) IsMounted() (bool, error) {
-	ret := C.ploop_is_mounted(d.d)
-	if ret == 0 {
-		return false, nil
-	} else if ret == 1 {
-		return true, nil
-	} else {
-		// error, but no code, make our own
-		return false, mkerr(E_SYS)
+	var mounted bool
+
+	err := d.do(func(di *cDisk) error {
+		ret := C.ploop_is_mounted(di)
+		if ret == 0 {
+			mounted = false
+		} else if ret == 1 {
+			mounted = true
+		} else {
+			// error, but no code, make our own
+			return mkerr(E_SYS)
+		}
+		return nil
+	})
+
+	return mounted, err
+}
+
+// Device returns information about the ploop device the image is
+// attached to, read from sysfs. If ploop is not mounted, an error
+// for which IsNotMounted() is true is returned.
+func (d Ploop) Device() (DeviceInfo, error) {
+	file, err := d.TopDeltaFile()
+	if err != nil {
+		return DeviceInfo{}, err
 	}
+
+	return findByTopDelta(file)
 }
 
-// FSInfoData holds information about ploop inner file system
-type FSInfoData struct {
-	BlockSize  uint64
-	Blocks     uint64
-	BlocksFree uint64
-	Inodes     uint64
-	InodesFree uint64
+// Quota returns a Quota to manage disk quotas of the ploop inner
+// file system, which should be mounted
+func (d Ploop) Quota() (*Quota, error) {
+	i, err := d.Device()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewQuota(i)
 }
 
 // FSInfo gets info of ploop's inner file system
@@ -388,23 +676,24 @@ func FSInfo(file string) (FSInfoData, error) {
 
 	once.Do(loadKmod)
 
-	ret := C.ploop_get_info_by_descr(cfile, &cinfo)
-	if ret == 0 {
-		info.BlockSize = uint64(cinfo.fs_bsize)
-		info.Blocks = uint64(cinfo.fs_blocks)
-		info.BlocksFree = uint64(cinfo.fs_bfree)
-		info.Inodes = uint64(cinfo.fs_inodes)
-		info.InodesFree = uint64(cinfo.fs_ifree)
+	err := call(func() C.int {
+		return C.ploop_get_info_by_descr(cfile, &cinfo)
+	})
+	if err != nil {
+		// libploop only knows about ext file systems,
+		// others can be looked at if mounted
+		if i, e := mountedFSInfo(file); e == nil {
+			return i, nil
+		}
+		return info, err
 	}
+	info.BlockSize = uint64(cinfo.fs_bsize)
+	info.Blocks = uint64(cinfo.fs_blocks)
+	info.BlocksFree = uint64(cinfo.fs_bfree)
+	info.Inodes = uint64(cinfo.fs_inodes)
+	info.InodesFree = uint64(cinfo.fs_ifree)
 
-	return info, mkerr(ret)
-}
-
-// ImageInfoData holds information about ploop image
-type ImageInfoData struct {
-	Blocks    uint64
-	BlockSize uint32
-	Version   int
+	return info, nil
 }
 
 // ImageInfo gets information about a ploop image
@@ -412,14 +701,16 @@ func (d Ploop) ImageInfo() (ImageInfoData, error) {
 	var cinfo C.struct_ploop_spec
 	var info ImageInfoData
 
-	ret := C.ploop_get_spec(d.d, &cinfo)
-	if ret == 0 {
+	err := d.call(func(di *cDisk) C.int {
+		return C.ploop_get_spec(di, &cinfo)
+	})
+	if err == nil {
 		info.Blocks = uint64(cinfo.size)
 		info.BlockSize = uint32(cinfo.blocksize)
 		info.Version = int(cinfo.fmt_version)
 	}
 
-	return info, mkerr(ret)
+	return info, err
 }
 
 // TopDeltaFile returns file name of top delta
@@ -427,10 +718,16 @@ func (d Ploop) TopDeltaFile() (string, error) {
 	const len = 4096 // PATH_MAX
 	var out [len]C.char
 
-	ret := C.ploop_get_top_delta_fname(d.d, &out[0], len)
-	if ret != 0 {
-		// error, but no code, make our own
-		return "", mkerr(E_SYS)
+	err := d.do(func(di *cDisk) error {
+		ret := C.ploop_get_top_delta_fname(di, &out[0], len)
+		if ret != 0 {
+			// error, but no code, make our own
+			return mkerr(E_SYS)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
 	file := C.GoString(&out[0])
@@ -441,9 +738,11 @@ func (d Ploop) TopDeltaFile() (string, error) {
 func UUID() (string, error) {
 	var cuuid [39]C.char
 
-	ret := C.ploop_uuid_generate(&cuuid[0], 39)
-	if ret != 0 {
-		return "", mkerr(ret)
+	err := call(func() C.int {
+		return C.ploop_uuid_generate(&cuuid[0], 39)
+	})
+	if err != nil {
+		return "", err
 	}
 
 	uuid := C.GoString(&cuuid[0])
@@ -0,0 +1,253 @@
+package ploop
+
+// Incremental backup and restore, in pure Go.
+//
+// Backup stream format. All integers are little-endian.
+//
+//	header:  magic       [8]byte  "PLOOPBAK"
+//	         version     uint32   1
+//	         clusterSize uint32   cluster size, in bytes
+//	         diskSize    uint64   virtual disk size, in bytes
+//	         from        [40]byte snapshot UUID, zero padded (all zeroes for a full backup)
+//	         to          [40]byte snapshot UUID, zero padded
+//	records: offset      uint64   byte offset on the virtual disk (cluster aligned)
+//	         length      uint32   data length, in bytes (at most clusterSize)
+//	         flags       uint32   BackupZero, or 0
+//	         data        [length]byte (omitted if BackupZero is set)
+//	end:     offset      uint64   0xffffffffffffffff
+//	         length      uint32   0
+//	         flags       uint32   0
+//	         count       uint64   number of records, not counting the end one
+//
+// Records go in ascending offset order. A stream with no end record
+// is incomplete (e.g. truncated) and is rejected by Restore.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// BackupMagic is the signature of a backup stream
+const BackupMagic = "PLOOPBAK"
+
+// BackupVersion is the version of a backup stream format
+const BackupVersion = 1
+
+// BackupZero is a backup record flag meaning the data are all zeroes
+// (and are not included in the stream)
+const BackupZero = 0x1
+
+const (
+	backupUUIDLen    = 40
+	backupHeaderSize = 8 + 4 + 4 + 8 + 2*backupUUIDLen
+	backupRecordSize = 8 + 4 + 4
+	backupEnd        = math.MaxUint64
+)
+
+// BackupHeader holds the information from a backup stream header
+type BackupHeader struct {
+	ClusterSize uint32 // cluster size, in bytes
+	DiskSize    uint64 // virtual disk size, in bytes
+	From        string // base snapshot UUID, empty for a full backup
+	To          string // snapshot UUID the backup is taken from
+}
+
+// BackupStat holds the statistics of a backup
+type BackupStat struct {
+	Clusters int    // number of clusters written
+	Zero     int    // number of them which are all zeroes
+	Bytes    uint64 // amount of data written, in bytes
+}
+
+// writeBackup writes clusters which differ between snapshots from and to
+// (or all allocated clusters of to, if from is empty) to w, in backup
+// stream format. A cluster differs if it is allocated in any delta which
+// is not shared by both snapshot delta chains. size and clusterBytes
+// are the virtual disk size and cluster size, in bytes, and raw is set
+// if the base delta is raw (so all its clusters are allocated).
+func writeBackup(s []SnapshotInfo, size uint64, clusterBytes int64, raw bool, from, to string, w io.Writer) (BackupStat, error) {
+	var stat BackupStat
+
+	if to == "" {
+		return stat, &Err{c: E_PARAM, s: "snapshot uuid to backup is not set"}
+	}
+	toChain := chainOf(s, to)
+	if len(toChain) == 0 {
+		return stat, &Err{c: E_NOSNAP, s: "no such snapshot " + to}
+	}
+	var fromChain []SnapshotInfo
+	if from != "" {
+		if fromChain = chainOf(s, from); len(fromChain) == 0 {
+			return stat, &Err{c: E_NOSNAP, s: "no such snapshot " + from}
+		}
+	}
+	common := 0
+	for common < len(toChain) && common < len(fromChain) &&
+		toChain[common].UUID == fromChain[common].UUID {
+		common++
+	}
+
+	// deltas are opened top first
+	files := func(c []SnapshotInfo) []string {
+		var f []string
+		for n := len(c) - 1; n >= 0; n-- {
+			f = append(f, c[n].File)
+		}
+		return f
+	}
+	data, err := openDeltas(files(toChain), raw, size, clusterBytes)
+	if err != nil {
+		return stat, err
+	}
+	defer data.close()
+	// deltas with changes (from both chains)
+	// (the base delta is only among them for a full backup)
+	changed, err := openDeltas(append(files(toChain[common:]), files(fromChain[common:])...), raw && common == 0, size, data.clusterBytes)
+	if err != nil {
+		return stat, err
+	}
+	defer changed.close()
+
+	h := BackupHeader{ClusterSize: uint32(data.clusterBytes), DiskSize: size, From: from, To: to}
+	if _, err = w.Write(h.marshal()); err != nil {
+		return stat, &Err{c: E_WRITE, s: err.Error()}
+	}
+
+	b := make([]byte, data.clusterBytes)
+	rec := make([]byte, backupRecordSize)
+	for _, n := range changed.allocated() {
+		if err = data.readCluster(n, b); err != nil {
+			return stat, err
+		}
+		off := uint64(n) * uint64(data.clusterBytes)
+		chunk := b[:min(uint64(len(b)), size-off)]
+		flags := uint32(0)
+		if isZero(chunk) {
+			flags = BackupZero
+		}
+		putRecord(rec, off, uint32(len(chunk)), flags)
+		_, err = w.Write(rec)
+		if err == nil && flags == 0 {
+			_, err = w.Write(chunk)
+		}
+		if err != nil {
+			return stat, &Err{c: E_WRITE, s: err.Error()}
+		}
+		stat.Clusters++
+		if flags == 0 {
+			stat.Bytes += uint64(len(chunk))
+		} else {
+			stat.Zero++
+		}
+	}
+
+	putRecord(rec, backupEnd, 0, 0)
+	rec = binary.LittleEndian.AppendUint64(rec, uint64(stat.Clusters))
+	if _, err = w.Write(rec); err != nil {
+		return stat, &Err{c: E_WRITE, s: err.Error()}
+	}
+
+	return stat, nil
+}
+
+func putRecord(b []byte, off uint64, length, flags uint32) {
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], off)
+	le.PutUint32(b[8:], length)
+	le.PutUint32(b[12:], flags)
+}
+
+func (h *BackupHeader) marshal() []byte {
+	b := make([]byte, backupHeaderSize)
+	le := binary.LittleEndian
+
+	copy(b, BackupMagic)
+	le.PutUint32(b[8:], BackupVersion)
+	le.PutUint32(b[12:], h.ClusterSize)
+	le.PutUint64(b[16:], h.DiskSize)
+	copy(b[24:24+backupUUIDLen], h.From)
+	copy(b[24+backupUUIDLen:], h.To)
+
+	return b
+}
+
+func (h *BackupHeader) unmarshal(b []byte) error {
+	le := binary.LittleEndian
+
+	if string(b[:8]) != BackupMagic {
+		return &Err{c: E_PROTOCOL, s: "not a backup stream (bad magic)"}
+	}
+	if v := le.Uint32(b[8:]); v != BackupVersion {
+		return &Err{c: E_PROTOCOL, s: "unsupported backup stream version"}
+	}
+	h.ClusterSize = le.Uint32(b[12:])
+	h.DiskSize = le.Uint64(b[16:])
+	h.From = string(bytes.TrimRight(b[24:24+backupUUIDLen], "\x00"))
+	h.To = string(bytes.TrimRight(b[24+backupUUIDLen:], "\x00"))
+	if h.ClusterSize == 0 {
+		return &Err{c: E_PROTOCOL, s: "bad cluster size"}
+	}
+
+	return nil
+}
+
+// Restore reads a backup stream, as written by Backup, from r and
+// applies it onto w, which is either a ploop device (of a ploop the
+// backup was made from, or a copy of it), or a raw disk image. To
+// restore a series of incremental backups, apply the full one first,
+// followed by incremental ones in the order they were taken.
+//
+// The stream header is returned, so the caller can check that
+// backups are applied in the correct order.
+func Restore(r io.Reader, w io.WriterAt) (BackupHeader, error) {
+	var h BackupHeader
+
+	b := make([]byte, backupHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, &Err{c: E_READ, s: err.Error()}
+	}
+	if err := h.unmarshal(b); err != nil {
+		return h, err
+	}
+
+	le := binary.LittleEndian
+	data := make([]byte, h.ClusterSize)
+	zero := make([]byte, h.ClusterSize)
+	rec := make([]byte, backupRecordSize)
+	count := uint64(0)
+	for {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return h, &Err{c: E_READ, s: err.Error()}
+		}
+		off := le.Uint64(rec[0:])
+		length := le.Uint32(rec[8:])
+		flags := le.Uint32(rec[12:])
+
+		if off == backupEnd {
+			if _, err := io.ReadFull(r, rec[:8]); err != nil {
+				return h, &Err{c: E_READ, s: err.Error()}
+			}
+			if le.Uint64(rec) != count {
+				return h, &Err{c: E_PROTOCOL, s: "backup stream record count mismatch"}
+			}
+			return h, nil
+		}
+		if length > h.ClusterSize || off+uint64(length) > h.DiskSize {
+			return h, &Err{c: E_PROTOCOL, s: "bad backup stream record"}
+		}
+
+		buf := zero[:length]
+		if flags&BackupZero == 0 {
+			buf = data[:length]
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return h, &Err{c: E_READ, s: err.Error()}
+			}
+		}
+		if _, err := w.WriteAt(buf, int64(off)); err != nil {
+			return h, &Err{c: E_WRITE, s: err.Error()}
+		}
+		count++
+	}
+}
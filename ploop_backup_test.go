@@ -0,0 +1,105 @@
+package ploop
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolyshkin/goploop/format"
+)
+
+// mkdelta writes a delta with 4 clusters of 4K, with given
+// clusters filled with given bytes (0 means allocated zeroes)
+func mkdelta(t *testing.T, file string, data map[uint32]byte) {
+	w, err := format.Create(file, 32, 8)
+	if err != nil {
+		t.Fatalf("format.Create: %s", err)
+	}
+	for c, v := range data {
+		if err = w.Write(c, bytes.Repeat([]byte{v}, 4096)); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	f := func(n string) string { return filepath.Join(dir, n) }
+
+	mkdelta(t, f("base"), map[uint32]byte{0: 'a', 1: 'b', 2: 'c'})
+	mkdelta(t, f("snap"), map[uint32]byte{1: 'B'})
+	mkdelta(t, f("top"), map[uint32]byte{2: 0, 3: 'D'})
+	s := []SnapshotInfo{
+		{UUID: "A", ParentUUID: NoneUUID, File: f("base")},
+		{UUID: "B", ParentUUID: "A", File: f("snap")},
+		{UUID: "C", ParentUUID: "B", File: f("top"), Current: true},
+	}
+
+	disk, err := os.Create(f("disk.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	expect := func(what string, clusters string) {
+		t.Helper()
+		b, err := os.ReadFile(f("disk.raw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := range clusters {
+			want := clusters[n]
+			if want == '0' {
+				want = 0
+			}
+			if n*4096 >= len(b) && want == 0 {
+				continue
+			}
+			if n*4096 >= len(b) || b[n*4096] != want || b[n*4096+4095] != want {
+				t.Errorf("%s: cluster %d: expected %q", what, n, want)
+			}
+		}
+	}
+
+	var full, incr bytes.Buffer
+	st, err := writeBackup(s, 16384, 4096, false, "", "B", &full)
+	if err != nil {
+		t.Fatalf("full backup: %s", err)
+	}
+	if st.Clusters != 3 || st.Zero != 0 || st.Bytes != 3*4096 {
+		t.Errorf("full backup: bad stat %+v", st)
+	}
+	st, err = writeBackup(s, 16384, 4096, false, "B", "C", &incr)
+	if err != nil {
+		t.Fatalf("incremental backup: %s", err)
+	}
+	if st.Clusters != 2 || st.Zero != 1 {
+		t.Errorf("incremental backup: bad stat %+v", st)
+	}
+
+	h, err := Restore(&full, disk)
+	if err != nil {
+		t.Fatalf("Restore full: %s", err)
+	}
+	if h.From != "" || h.To != "B" || h.ClusterSize != 4096 || h.DiskSize != 16384 {
+		t.Errorf("Restore full: bad header %+v", h)
+	}
+	expect("full", "aBc0")
+
+	trunc := bytes.NewReader(incr.Bytes()[:incr.Len()-8])
+	if _, err = Restore(trunc, disk); !IsError(err, E_READ) {
+		t.Errorf("Restore truncated: expected E_READ, got %v", err)
+	}
+	if _, err = Restore(&incr, disk); err != nil {
+		t.Fatalf("Restore incremental: %s", err)
+	}
+	expect("incremental", "aB0D")
+
+	if _, err = writeBackup(s, 16384, 4096, false, "X", "C", &incr); !IsError(err, E_NOSNAP) {
+		t.Errorf("backup from unknown snapshot: expected E_NOSNAP, got %v", err)
+	}
+}
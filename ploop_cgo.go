@@ -3,8 +3,22 @@ package ploop
 // A few auxiliary helpers to simplify life with CGo
 
 // #include <stdlib.h>
+// #include <ploop/libploop.h>
 import "C"
-import "unsafe"
+import (
+	"runtime"
+	"unsafe"
+)
+
+// Make sure constants in ploop_types.go are in sync with libploop.
+// Any mismatch results in an "index out of range" compile error.
+var _ = [1]struct{}{}[Expanded-C.PLOOP_EXPANDED_MODE]
+var _ = [1]struct{}{}[Preallocated-C.PLOOP_EXPANDED_PREALLOCATED_MODE]
+var _ = [1]struct{}{}[Raw-C.PLOOP_RAW_MODE]
+var _ = [1]struct{}{}[NoLazy-C.PLOOP_CREATE_NOLAZY]
+var _ = [1]struct{}{}[SkipDestroy-C.PLOOP_SNAP_SKIP_TOPDELTA_DESTROY]
+var _ = [1]struct{}{}[SkipCreate-C.PLOOP_SNAP_SKIP_TOPDELTA_CREATE]
+var _ = [1]struct{}{}[KeepName-C.PLOOP_REPLACE_KEEP_NAME]
 
 // cfree frees a C string
 func cfree(c *C.char) {
@@ -23,3 +37,23 @@ func boolToC(v bool) C.int {
 func convertSize(size uint64) C.ulonglong {
 	return C.ulonglong(size * 2) // kB to 512-byte sectors
 }
+
+// call runs fn, a libploop call not related to any particular disk
+// descriptor, and converts its return code to an error. The calling
+// goroutine is locked to its OS thread for the duration of the call,
+// so that libploop's last error string belongs to this call.
+func call(fn func() C.int) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	return mkerr(fn())
+}
+
+// mkerr converts a libploop return code to an error
+func mkerr(ret C.int) error {
+	if ret == 0 {
+		return nil
+	}
+
+	return &Err{c: int(ret), s: C.GoString(C.ploop_get_last_error())}
+}
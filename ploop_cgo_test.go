@@ -0,0 +1,20 @@
+//go:build cgo
+
+package ploop
+
+import "testing"
+
+func TestClosed(t *testing.T) {
+	var d Ploop
+
+	// Close on a never opened Ploop should not crash
+	d.Close()
+	d.Close()
+
+	if _, err := d.IsMounted(); err != ErrClosed {
+		t.Errorf("IsMounted: expected ErrClosed, got %v", err)
+	}
+	if err := d.Umount(); err != ErrClosed {
+		t.Errorf("Umount: expected ErrClosed, got %v", err)
+	}
+}
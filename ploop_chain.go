@@ -0,0 +1,268 @@
+package ploop
+
+// Reading ploop delta chains in pure Go, without libploop
+
+import (
+	"io"
+	"os"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+// delta is a single opened delta image of a chain
+type delta interface {
+	Offset(cluster uint32) (int64, bool)
+	ReadCluster(cluster uint32, b []byte) (bool, error)
+	File() *os.File
+	InUse() bool
+	Close() error
+}
+
+// rawDelta is a raw base delta, in which every virtual cluster is
+// allocated at the same offset in the file (identity mapping). The file
+// might be shorter than the virtual disk, the rest reads as zeroes.
+type rawDelta struct {
+	f            *os.File
+	clusterBytes int64
+}
+
+func openRaw(file string, clusterBytes int64) (*rawDelta, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return &rawDelta{f: f, clusterBytes: clusterBytes}, nil
+}
+
+func (r *rawDelta) Offset(cluster uint32) (int64, bool) {
+	return int64(cluster) * r.clusterBytes, true
+}
+
+func (r *rawDelta) ReadCluster(cluster uint32, b []byte) (bool, error) {
+	b = b[:r.clusterBytes]
+	n, err := r.f.ReadAt(b, int64(cluster)*r.clusterBytes)
+	if err == io.EOF {
+		clear(b[n:])
+		err = nil
+	}
+	return true, err
+}
+
+func (r *rawDelta) File() *os.File {
+	return r.f
+}
+
+func (r *rawDelta) InUse() bool {
+	return false
+}
+
+func (r *rawDelta) Close() error {
+	return r.f.Close()
+}
+
+// chain is a stack of delta images of a ploop, opened read-only
+type chain struct {
+	deltas       []delta // top delta first
+	size         uint64  // virtual disk size, in bytes
+	clusterBytes int64
+}
+
+// openChain opens all the deltas from a snapshot with a given uuid
+// (or the top delta, if uuid is empty) down to the base delta.
+// path is either a DiskDescriptor.xml or a directory containing it.
+func openChain(path, uuid string) (*chain, error) {
+	dd, err := descriptor.Load(path)
+	if err != nil {
+		return nil, &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	if dd.KeyID != "" {
+		// deltas hold encrypted data, which can't be read here
+		return nil, &Err{c: E_PARAM, s: "image is encrypted"}
+	}
+	images, err := dd.Chain(uuid)
+	if err != nil {
+		return nil, &Err{c: E_NOSNAP, s: err.Error()}
+	}
+
+	var files []string
+	for _, i := range images {
+		files = append(files, dd.ImagePath(i))
+	}
+	// in raw mode, only the base delta is raw, the rest are ploop1
+	raw := images[len(images)-1].Type == descriptor.TypeRaw
+
+	return openDeltas(files, raw, dd.Size*format.SectorSize, int64(dd.BlockSize)*format.SectorSize)
+}
+
+// openDeltas opens delta files (top delta first) of a given virtual
+// disk size and cluster size (both in bytes). If raw is set, the last
+// (base) delta is a raw image. If clusterBytes is 0, the cluster size
+// of the first delta is used.
+func openDeltas(files []string, raw bool, size uint64, clusterBytes int64) (*chain, error) {
+	c := &chain{size: size, clusterBytes: clusterBytes}
+	for n, file := range files {
+		if raw && n == len(files)-1 {
+			if c.clusterBytes == 0 {
+				c.close()
+				return nil, &Err{c: E_PARAM, s: file + ": unknown cluster size of a raw delta"}
+			}
+			r, err := openRaw(file, c.clusterBytes)
+			if err != nil {
+				c.close()
+				return nil, &Err{c: E_OPEN, s: err.Error()}
+			}
+			c.deltas = append(c.deltas, r)
+			break
+		}
+		d, err := format.Open(file)
+		if err != nil {
+			c.close()
+			return nil, &Err{c: E_PLOOPFMT, s: err.Error()}
+		}
+		c.deltas = append(c.deltas, d)
+		if c.clusterBytes == 0 {
+			c.clusterBytes = d.ClusterBytes()
+		}
+		if d.ClusterBytes() != c.clusterBytes {
+			c.close()
+			return nil, &Err{c: E_PLOOPFMT, s: file + ": cluster size mismatch"}
+		}
+	}
+
+	return c, nil
+}
+
+// close closes all the deltas
+func (c *chain) close() {
+	for _, d := range c.deltas {
+		d.Close()
+	}
+}
+
+// clusters returns the virtual disk size, in clusters
+func (c *chain) clusters() uint32 {
+	return uint32((int64(c.size) + c.clusterBytes - 1) / c.clusterBytes)
+}
+
+// inUse returns true if any of the deltas has its in-use flag set
+func (c *chain) inUse() bool {
+	for _, d := range c.deltas {
+		if d.InUse() {
+			return true
+		}
+	}
+	return false
+}
+
+// allocated returns the sorted list of virtual clusters
+// which are allocated in any of the deltas
+func (c *chain) allocated() []uint32 {
+	var ret []uint32
+	for n := uint32(0); n < c.clusters(); n++ {
+		if d, _ := c.lookup(n); d != nil {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// lookup returns the topmost delta which has a given virtual cluster
+// allocated, and the cluster offset in it, or nil if none has
+func (c *chain) lookup(cluster uint32) (delta, int64) {
+	for _, d := range c.deltas {
+		if off, ok := d.Offset(cluster); ok {
+			return d, off
+		}
+	}
+	return nil, 0
+}
+
+// readCluster reads a virtual cluster into b, from the topmost delta
+// which has it allocated, or fills b with zeroes if none has
+func (c *chain) readCluster(cluster uint32, b []byte) error {
+	b = b[:c.clusterBytes]
+	for _, d := range c.deltas {
+		ok, err := d.ReadCluster(cluster, b)
+		if err != nil {
+			return &Err{c: E_READ, s: err.Error()}
+		}
+		if ok {
+			return nil
+		}
+	}
+	clear(b)
+	return nil
+}
+
+// ChainReader reads a ploop virtual disk directly from its delta files,
+// without libploop or the ploop kernel module. It implements io.ReaderAt,
+// and is safe for concurrent use. Unallocated clusters read as zeroes.
+type ChainReader struct {
+	c *chain
+}
+
+// OpenChainReader opens all the deltas of a snapshot with a given uuid
+// (or of the top delta, if uuid is empty) for reading. path is either
+// a DiskDescriptor.xml or a directory containing it. Deltas are read
+// as is, so if the ploop is mounted, a snapshot (rather than the top
+// delta, which is being changed) should be read. Encrypted images
+// can not be read.
+func OpenChainReader(path, uuid string) (*ChainReader, error) {
+	c, err := openChain(path, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &ChainReader{c: c}, nil
+}
+
+// Close closes all the delta files
+func (r *ChainReader) Close() error {
+	r.c.close()
+	return nil
+}
+
+// Size returns the virtual disk size, in bytes
+func (r *ChainReader) Size() int64 {
+	return int64(r.c.size)
+}
+
+// Blocks returns the virtual disk size, in 512-byte sectors,
+// the same as ImageInfo().Blocks
+func (r *ChainReader) Blocks() uint64 {
+	return r.c.size / format.SectorSize
+}
+
+// ReadAt reads the virtual disk contents at a given offset.
+// It implements io.ReaderAt.
+func (r *ChainReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &Err{c: E_PARAM, s: "negative offset"}
+	}
+	c := r.c
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= int64(c.size) {
+			return n, io.EOF
+		}
+		in := pos % c.clusterBytes
+		chunk := min(c.clusterBytes-in, int64(c.size)-pos, int64(len(b)-n))
+		dst := b[n : n+int(chunk)]
+
+		d, doff := c.lookup(uint32(pos / c.clusterBytes))
+		if d != nil {
+			m, err := d.File().ReadAt(dst, doff+in)
+			if err == io.EOF {
+				// a raw delta might be shorter than the disk
+				clear(dst[m:])
+			} else if err != nil {
+				return n, err
+			}
+		} else {
+			clear(dst)
+		}
+		n += int(chunk)
+	}
+	return n, nil
+}
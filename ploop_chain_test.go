@@ -0,0 +1,112 @@
+package ploop
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolyshkin/goploop/descriptor"
+)
+
+func TestChainReader(t *testing.T) {
+	dir := t.TempDir()
+
+	mkdelta(t, filepath.Join(dir, "root.hdd"), map[uint32]byte{0: 'a', 1: 'b'})
+	mkdelta(t, filepath.Join(dir, "root.hdd.1"), map[uint32]byte{1: 'B', 3: 'D'})
+	dd := descriptor.New(32, 8, "root.hdd")
+	base := dd.TopGUID
+	if err := dd.AddDelta(descriptor.NewGUID(), "root.hdd.1"); err != nil {
+		t.Fatalf("AddDelta: %s", err)
+	}
+	if err := dd.Save(dir); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	r, err := OpenChainReader(dir, "")
+	if err != nil {
+		t.Fatalf("OpenChainReader: %s", err)
+	}
+	defer r.Close()
+	if r.Blocks() != 32 || r.Size() != 16384 {
+		t.Errorf("bad size: %d blocks, %d bytes", r.Blocks(), r.Size())
+	}
+
+	// read across all four clusters
+	b := make([]byte, 3*4096+1)
+	n, err := r.ReadAt(b, 4095)
+	if err != nil || n != len(b) {
+		t.Fatalf("ReadAt: %d %v", n, err)
+	}
+	if string([]byte{b[0], b[1], b[4096], b[4097], b[8193], b[len(b)-1]}) != "aBB\x00DD" {
+		t.Errorf("ReadAt: bad data")
+	}
+	if n, err = r.ReadAt(b, r.Size()-10); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at the end: expected 10, EOF, got %d, %v", n, err)
+	}
+
+	// base snapshot only
+	rb, err := OpenChainReader(filepath.Join(dir, descriptor.FileName), base)
+	if err != nil {
+		t.Fatalf("OpenChainReader(base): %s", err)
+	}
+	defer rb.Close()
+	if _, err = rb.ReadAt(b[:1], 4096); err != nil || b[0] != 'b' {
+		t.Errorf("ReadAt(base): %q %v", b[0], err)
+	}
+
+	if _, err = OpenChainReader(dir, "{no-such-uuid}"); !IsError(err, E_NOSNAP) {
+		t.Errorf("OpenChainReader: expected E_NOSNAP, got %v", err)
+	}
+
+	// data of encrypted images can't be read
+	dd.KeyID = "key-1"
+	if err = dd.Save(dir); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+	if _, err = OpenChainReader(dir, ""); !IsError(err, E_PARAM) {
+		t.Errorf("OpenChainReader: expected E_PARAM for an encrypted image, got %v", err)
+	}
+}
+
+func TestChainReaderRaw(t *testing.T) {
+	dir := t.TempDir()
+
+	// raw base delta, shorter than the disk
+	raw := append(bytes.Repeat([]byte{'a'}, 4096), bytes.Repeat([]byte{'b'}, 4096)...)
+	if err := os.WriteFile(filepath.Join(dir, "root.hdd"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mkdelta(t, filepath.Join(dir, "root.hdd.1"), map[uint32]byte{1: 'B'})
+	dd := descriptor.New(32, 8, "root.hdd")
+	dd.Images[0].Type = descriptor.TypeRaw
+	if err := dd.AddDelta(descriptor.NewGUID(), "root.hdd.1"); err != nil {
+		t.Fatalf("AddDelta: %s", err)
+	}
+	if err := dd.Save(dir); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	r, err := OpenChainReader(dir, "")
+	if err != nil {
+		t.Fatalf("OpenChainReader: %s", err)
+	}
+	defer r.Close()
+
+	b := make([]byte, r.Size())
+	if n, err := r.ReadAt(b, 0); err != nil || n != len(b) {
+		t.Fatalf("ReadAt: %d %v", n, err)
+	}
+	if string([]byte{b[0], b[4095], b[4096], b[8191], b[8192], b[len(b)-1]}) != "aaBB\x00\x00" {
+		t.Errorf("ReadAt: bad data")
+	}
+
+	var out bytes.Buffer
+	if err = Export(dir, "", &out, StreamRaw); err != nil {
+		t.Fatalf("Export: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Errorf("Export: data differs from ReadAt")
+	}
+}
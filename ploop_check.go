@@ -0,0 +1,116 @@
+package ploop
+
+import "github.com/kolyshkin/goploop/format"
+
+// #include <ploop/libploop.h>
+import "C"
+
+// CheckParam is a set of parameters for Check()
+type CheckParam struct {
+	ReadOnly  bool // only scan the image, do not modify it
+	Repair    bool // try to fix all problems found, even fatal ones
+	DropInUse bool // drop image in-use flag
+	CheckFS   bool // also check the inner file system (requires mount)
+}
+
+// CheckReport holds the results of an image check
+type CheckReport struct {
+	File      string           // image file checked
+	Problems  []format.Problem // problems found before any repair
+	Remaining []format.Problem // problems left after repair (same as Problems if ReadOnly)
+}
+
+// Clean returns true if the image has no problems (left)
+func (r *CheckReport) Clean() bool {
+	return len(r.Remaining) == 0
+}
+
+// scan checks an image file for problems in pure Go
+func scan(file string) ([]format.Problem, error) {
+	i, err := format.Open(file)
+	if err != nil {
+		return nil, &Err{c: E_PLOOPFMT, s: err.Error()}
+	}
+	defer i.Close()
+
+	p, err := i.Check()
+	if err != nil {
+		return nil, &Err{c: E_READ, s: err.Error()}
+	}
+	return p, nil
+}
+
+// Check checks a ploop image file (a single delta) for consistency,
+// the same way as "ploop check" does, and optionally repairs it.
+// Problems found are reported in a structured way. An error is returned
+// if the image can not be checked, or if libploop failed to repair it.
+func Check(file string, p CheckParam) (CheckReport, error) {
+	r := CheckReport{File: file}
+
+	problems, err := scan(file)
+	if err != nil {
+		return r, err
+	}
+	r.Problems = problems
+	r.Remaining = problems
+
+	flags := C.CHECK_DETAILED
+	if p.ReadOnly {
+		flags |= C.CHECK_READONLY
+	} else {
+		if p.Repair {
+			flags |= C.CHECK_FORCE | C.CHECK_HARDFORCE | C.CHECK_REPAIR_SPARSE
+		}
+		if p.DropInUse {
+			flags |= C.CHECK_DROPINUSE
+		}
+	}
+	if p.CheckFS {
+		flags |= C.CHECK_CHECKFS
+	}
+
+	cfile := C.CString(file)
+	defer cfree(cfile)
+
+	var blocksize C.__u32
+	var cbt C.int // set by libploop if the image can keep CBT data
+	err = call(func() C.int {
+		return C.ploop_check(cfile, C.int(flags), &blocksize, &cbt)
+	})
+	if err != nil || p.ReadOnly {
+		return r, err
+	}
+
+	// see what's left after libploop did its job
+	r.Remaining, err = scan(file)
+	return r, err
+}
+
+// Check checks all the deltas in the current top delta chain,
+// from the base delta up to the top delta, using Check().
+// In Raw mode, the base delta has no metadata to check, so it is
+// skipped. It stops at the first error.
+func (d Ploop) Check(p CheckParam) ([]CheckReport, error) {
+	s, err := d.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	mode, err := d.Mode()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []CheckReport
+	for n, file := range deltaChain(s, "") {
+		if n == 0 && mode == Raw {
+			continue
+		}
+		r, err := Check(file, p)
+		ret = append(ret, r)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,112 @@
+package ploop
+
+import "context"
+
+// #include <ploop/libploop.h>
+import "C"
+
+// DiscardStatData holds ploop image space usage statistics, in bytes
+type DiscardStatData struct {
+	DataSize    uint64 // space used by data in the inner file system
+	PloopSize   uint64 // ploop device size
+	ImageSize   uint64 // total size of image files on the host
+	BalloonSize uint64 // size of the balloon file
+}
+
+// Reclaimable returns an estimate of how much space (in bytes)
+// can be reclaimed by compacting the image
+func (s *DiscardStatData) Reclaimable() uint64 {
+	if s.ImageSize <= s.DataSize {
+		return 0
+	}
+	return s.ImageSize - s.DataSize
+}
+
+// CompactParam is a set of parameters for Compact()
+type CompactParam struct {
+	// MinBlock is the minimum size of a contiguous free extent
+	// to be discarded, in bytes. Zero means libploop default.
+	MinBlock uint64
+	// ToFree is the amount of space to free, in bytes;
+	// compaction stops once it's reached. Zero means no limit.
+	ToFree uint64
+	// Threshold is a minimum reclaimable space, in percent of the image
+	// size. If less space can be reclaimed (i.e. image fragmentation
+	// is low), compaction is not performed.
+	Threshold uint
+	Defrag    bool // also defragment the image
+	DryRun    bool // only report how much space can be reclaimed
+}
+
+// CompactResult is what Compact() returns
+type CompactResult struct {
+	Before    DiscardStatData // statistics before compaction
+	After     DiscardStatData // statistics after compaction
+	Skipped   bool            // compaction was not performed (dry run or below threshold)
+	Reclaimed uint64          // image size reduction, in bytes
+}
+
+// DiscardStat returns space usage statistics of a mounted ploop image
+func (d Ploop) DiscardStat() (DiscardStatData, error) {
+	var cstat C.struct_ploop_discard_stat
+	var stat DiscardStatData
+
+	err := d.call(func(di *cDisk) C.int {
+		return C.ploop_discard_get_stat(di, &cstat)
+	})
+	if err == nil {
+		stat.DataSize = uint64(cstat.data_size)
+		stat.PloopSize = uint64(cstat.ploop_size)
+		stat.ImageSize = uint64(cstat.image_size)
+		stat.BalloonSize = uint64(cstat.balloon_size)
+	}
+
+	return stat, err
+}
+
+// Compact reclaims unused space of an expanded ploop image,
+// making image files smaller. The image must be mounted.
+func (d Ploop) Compact(p *CompactParam) (CompactResult, error) {
+	return d.CompactContext(context.Background(), p)
+}
+
+// CompactContext is the same as Compact, but can be cancelled via ctx.
+// See runContext for details.
+func (d Ploop) CompactContext(ctx context.Context, p *CompactParam) (CompactResult, error) {
+	var r CompactResult
+	var err error
+
+	r.Before, err = d.DiscardStat()
+	if err != nil {
+		return r, err
+	}
+	r.After = r.Before
+
+	reclaimable := r.Before.Reclaimable()
+	if p.DryRun || reclaimable == 0 ||
+		reclaimable*100 < uint64(p.Threshold)*r.Before.ImageSize {
+		r.Skipped = true
+		return r, nil
+	}
+
+	var a C.struct_ploop_discard_param
+	a.minlen_b = C.__u64(p.MinBlock)
+	a.to_free = C.__u64(p.ToFree)
+	a.defrag = boolToC(p.Defrag)
+
+	err = d.runContext(ctx, func(d Ploop) error {
+		return d.call(func(di *cDisk) C.int {
+			return C.ploop_discard(di, &a)
+		})
+	})
+	if err != nil {
+		return r, err
+	}
+
+	r.After, err = d.DiscardStat()
+	if err == nil && r.After.ImageSize < r.Before.ImageSize {
+		r.Reclaimed = r.Before.ImageSize - r.After.ImageSize
+	}
+
+	return r, err
+}
@@ -0,0 +1,80 @@
+package ploop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// #include <ploop/libploop.h>
+import "C"
+
+// cancelRetry is how often runContext repeats a cancel request
+// until the cancelled operation returns
+const cancelRetry = 100 * time.Millisecond
+
+// runContext runs fn, a blocking libploop call wrapper, in a separate
+// goroutine. fn is given a copy of d bound to ctx, which it should use
+// to make the call (e.g. via Ploop.call): once the descriptor lock is
+// acquired, the call is not made if ctx is already done. If ctx is done
+// before fn returns, libploop is asked to cancel the operation and
+// runContext waits for fn to return. As a cancel request made before
+// libploop starts the operation is lost, it is repeated until fn
+// returns. A cancelled operation fails with E_ABORT, and the error
+// returned also wraps ctx.Err(), so both IsError(err, E_ABORT) and
+// errors.Is(err, context.Canceled) (or context.DeadlineExceeded) are
+// true.
+//
+// Note that libploop cancellation is process-wide, i.e. all libploop
+// operations running at the moment are asked to cancel.
+func (d Ploop) runContext(ctx context.Context, fn func(d Ploop) error) error {
+	if ctx.Done() == nil {
+		// can't be cancelled, no need for a goroutine
+		return fn(d)
+	}
+	if err := ctx.Err(); err != nil {
+		return errAbort(err)
+	}
+
+	d.ctx = ctx
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(d)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	t := time.NewTicker(cancelRetry)
+	defer t.Stop()
+	for {
+		C.ploop_cancel_operation()
+		select {
+		case err := <-done:
+			if IsError(err, E_ABORT) && !errors.Is(err, ctx.Err()) {
+				err = fmt.Errorf("%w: %w", err, ctx.Err())
+			}
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// aborted returns an E_ABORT error if d is bound to a context
+// by runContext, and that context is done
+func (d Ploop) aborted() error {
+	if d.ctx != nil && d.ctx.Err() != nil {
+		return errAbort(d.ctx.Err())
+	}
+	return nil
+}
+
+// errAbort returns an E_ABORT error for an operation
+// not started because of a context error err
+func errAbort(err error) error {
+	return fmt.Errorf("%w: %w", &Err{c: E_ABORT, s: "operation cancelled"}, err)
+}
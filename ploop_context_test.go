@@ -0,0 +1,51 @@
+//go:build cgo
+
+package ploop
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextCancelled(t *testing.T) {
+	var d Ploop
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// should not even call libploop
+	err := d.ResizeContext(ctx, 1<<20, false)
+	if !IsError(err, E_ABORT) {
+		t.Errorf("ResizeContext: expected E_ABORT, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ResizeContext: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestContextCancelledWhileLocked(t *testing.T) {
+	// no libploop descriptor, so if the call was made, it would fail
+	// with ErrClosed rather than E_ABORT
+	d := Ploop{h: &handle{}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d.h.Lock()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.ResizeContext(ctx, 1<<20, false)
+	}()
+	cancel()
+	// let runContext see the cancellation while the call
+	// is still waiting for the descriptor lock
+	time.Sleep(2 * cancelRetry)
+	d.h.Unlock()
+
+	err := <-errc
+	if !IsError(err, E_ABORT) {
+		t.Errorf("ResizeContext: expected E_ABORT, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ResizeContext: expected context.Canceled, got %v", err)
+	}
+}
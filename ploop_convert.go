@@ -0,0 +1,76 @@
+package ploop
+
+import "context"
+
+// #include <ploop/libploop.h>
+import "C"
+
+// Mode returns the current image mode
+func (d Ploop) Mode() (ImageMode, error) {
+	var mode ImageMode
+
+	err := d.call(func(di *cDisk) C.int {
+		ret := C.ploop_read_dd(di)
+		if ret == 0 {
+			mode = ImageMode(di.mode)
+		}
+		return ret
+	})
+
+	return mode, err
+}
+
+// Convert converts the image to a given mode, rewriting its deltas and
+// updating DiskDescriptor.xml atomically. Snapshots are preserved.
+// Conversion between Expanded and Preallocated modes is done by libploop,
+// and can be done online. As libploop can't convert to or from Raw mode,
+// it is done by this package, by rewriting the base delta (the only one
+// which is raw in Raw mode), which requires the ploop to be unmounted.
+// Converting to the current mode is a no-op.
+func (d Ploop) Convert(mode ImageMode) error {
+	return d.ConvertContext(context.Background(), mode)
+}
+
+// ConvertContext is the same as Convert, but can be cancelled via ctx.
+// See runContext for details.
+func (d Ploop) ConvertContext(ctx context.Context, mode ImageMode) error {
+	switch mode {
+	case Expanded, Preallocated, Raw:
+	default:
+		return &Err{c: E_PARAM, s: "unknown image mode " + mode.String()}
+	}
+
+	return d.runContext(ctx, func(d Ploop) error {
+		return d.doMeta(func(di *cDisk, _ snapMeta) error {
+			if ret := C.ploop_read_dd(di); ret != 0 {
+				return mkerr(ret)
+			}
+			cur := ImageMode(di.mode)
+			if cur == mode {
+				return nil
+			}
+			if cur != Raw && mode != Raw {
+				return mkerr(C.ploop_convert_image(di, C.int(mode), 0))
+			}
+
+			switch C.ploop_is_mounted(di) {
+			case 0:
+			case 1:
+				return &Err{c: E_PARAM, s: "can't convert a mounted ploop to or from raw mode"}
+			default:
+				return mkerr(E_SYS)
+			}
+			if err := convertBase(d.h.file, mode == Raw, d.aborted); err != nil {
+				return err
+			}
+			if ret := C.ploop_read_dd(di); ret != 0 {
+				return mkerr(ret)
+			}
+			if mode == Preallocated {
+				// the base delta is now expanded, let libploop do the rest
+				return mkerr(C.ploop_convert_image(di, C.int(mode), 0))
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,220 @@
+package ploop
+
+// Rewriting deltas in pure Go, for what libploop can't do: conversion
+// to and from raw mode, merging of a range of deltas in one pass, and
+// decryption.
+// In raw mode, only the base delta is raw, the upper ones are ploop1
+// images, same as in expanded mode.
+
+import (
+	"io"
+	"os"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+// newSuffix is appended to a delta file name to get a name
+// of a new file to replace it
+const newSuffix = ".new"
+
+// convertBase rewrites the base delta of a ploop (path is either
+// a DiskDescriptor.xml or a directory containing it) as a raw image if
+// raw is set, or as an expanded ploop1 image otherwise, and updates the
+// descriptor accordingly. Snapshots are preserved. The image should not
+// be in use. abort is called for every cluster, and if it returns an
+// error, the conversion is stopped, leaving the image as it was.
+//
+// The whole conversion is done under the descriptor lock, and the
+// descriptor always refers to a complete base delta of a matching
+// type, so an interrupted conversion leaves the image usable.
+func convertBase(path string, raw bool, abort func() error) error {
+	unlock, err := descriptor.Lock(path)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	defer unlock()
+
+	dd, err := descriptor.Load(path)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	if dd.KeyID != "" {
+		return &Err{c: E_PARAM, s: "image is encrypted"}
+	}
+	images, err := dd.Chain("")
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	base := images[len(images)-1]
+	if (base.Type == descriptor.TypeRaw) == raw {
+		return nil
+	}
+	guid, name, file := base.GUID, base.File, dd.ImagePath(base)
+
+	c, err := openDeltas([]string{file}, !raw, dd.Size*format.SectorSize, int64(dd.BlockSize)*format.SectorSize)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	// a leftover of an interrupted conversion, not used by the descriptor
+	os.Remove(file + newSuffix)
+	if raw {
+		err = writeRaw(file+newSuffix, c, abort)
+	} else {
+		err = writeDelta(file+newSuffix, c, dd.Size, dd.BlockSize, true, abort)
+	}
+	if err != nil {
+		return err
+	}
+
+	typ := descriptor.TypeExpanded
+	if raw {
+		typ = descriptor.TypeRaw
+	}
+	return installImage(path, dd, guid, name, func() {
+		for n := range dd.Images {
+			dd.Images[n].Type = typ
+		}
+	})
+}
+
+// installImage makes an image with a given guid in dd (loaded from
+// path) use a file name, the new data for which is in a file named
+// name+newSuffix. update is called to make other changes to dd, which
+// are saved at the same time. As the new file might replace an
+// existing one with the same name, this is done in steps, so that
+// the descriptor always refers to complete files: dd is saved
+// referring to the new file, which is then renamed (by linking it, so
+// it is never missing), and dd is saved again.
+func installImage(path string, dd *descriptor.Descriptor, guid, name string, update func()) error {
+	update()
+	img := dd.Image(guid)
+	img.File = name + newSuffix
+	if err := dd.Save(path); err != nil {
+		os.Remove(dd.ImagePath(img))
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+
+	tmp := dd.ImagePath(img)
+	file := dd.ImagePath(&descriptor.Image{File: name})
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return &Err{c: E_SYS, s: err.Error()}
+	}
+	if err := os.Link(tmp, file); err != nil {
+		return &Err{c: E_SYS, s: err.Error()}
+	}
+	img.File = name
+	if err := dd.Save(path); err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	os.Remove(tmp)
+
+	return nil
+}
+
+// writeRaw writes the data of a delta chain c to a new sparse raw image
+// file. abort is called for every cluster, see convertBase.
+func writeRaw(file string, c *chain, abort func() error) (err error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return &Err{c: E_CREAT, s: err.Error()}
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = &Err{c: E_WRITE, s: cerr.Error()}
+		}
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+	size := int64(c.size)
+	if err = f.Truncate(size); err != nil {
+		return &Err{c: E_WRITE, s: err.Error()}
+	}
+
+	b := make([]byte, c.clusterBytes)
+	for _, n := range c.allocated() {
+		if err = abort(); err != nil {
+			return err
+		}
+		off := int64(n) * c.clusterBytes
+		if off >= size {
+			break
+		}
+		if err = c.readCluster(n, b); err != nil {
+			return err
+		}
+		if isZero(b) {
+			continue
+		}
+		if _, err = f.WriteAt(b[:min(c.clusterBytes, size-off)], off); err != nil {
+			return &Err{c: E_WRITE, s: err.Error()}
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return &Err{c: E_WRITE, s: err.Error()}
+	}
+
+	return nil
+}
+
+// writeDelta writes the data of a delta chain c to a new expanded
+// ploop1 image file, of a given size and cluster block size (both in
+// sectors). For a base delta, all-zero clusters can be skipped (see
+// writeImage). abort is called for every cluster, see convertBase.
+func writeDelta(file string, c *chain, size uint64, blockSize uint32, base bool, abort func() error) error {
+	return writeImage(file, size, blockSize, c.allocated(), base, func(n uint32, b []byte) error {
+		if err := abort(); err != nil {
+			return err
+		}
+		return c.readCluster(n, b)
+	})
+}
+
+// replaceBase replaces the base delta of a ploop (path is either
+// a DiskDescriptor.xml or a directory containing it), which should
+// have no snapshots, with an image file of the same type, and makes it
+// unencrypted (see Decrypt). The file is moved next to the base delta.
+func replaceBase(path, file string) error {
+	unlock, err := descriptor.Lock(path)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	defer unlock()
+
+	dd, err := descriptor.Load(path)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	if len(dd.Images) != 1 {
+		return &Err{c: E_PARAM, s: "image has snapshots"}
+	}
+	base := &dd.Images[0]
+	if err = os.Rename(file, dd.ImagePath(base)+newSuffix); err != nil {
+		return &Err{c: E_SYS, s: err.Error()}
+	}
+
+	return installImage(path, dd, base.GUID, base.File, func() {
+		dd.KeyID = ""
+	})
+}
+
+// copyData copies size bytes from src to dst, in chunks of a given
+// size, skipping all-zero ones, so dst should read as zeroes initially
+func copyData(dst io.WriterAt, src io.ReaderAt, size, chunk int64) error {
+	b := make([]byte, chunk)
+	for off := int64(0); off < size; off += chunk {
+		n := min(chunk, size-off)
+		if _, err := src.ReadAt(b[:n], off); err != nil {
+			return &Err{c: E_READ, s: err.Error()}
+		}
+		if isZero(b[:n]) {
+			continue
+		}
+		if _, err := dst.WriteAt(b[:n], off); err != nil {
+			return &Err{c: E_WRITE, s: err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package ploop
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+func TestConvertBase(t *testing.T) {
+	dir := t.TempDir()
+
+	// base delta with data in every third 32K cluster, and a snapshot
+	// on top of it, overwriting one cluster and adding another one
+	const cs = 32 << 10
+	raw := make([]byte, 40*cs)
+	for n := 0; n < 40; n += 3 {
+		raw[n*cs+100] = byte(n + 1)
+	}
+	p := CreateParam{File: filepath.Join(dir, DefaultFile), CLog: 6, Size: 40 * cs / 1024}
+	if err := Import(bytes.NewReader(raw), StreamRaw, &p); err != nil {
+		t.Fatal(err)
+	}
+	w, err := format.Create(filepath.Join(dir, "top.hdd"), 40*cs/512, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, cs)
+	for _, n := range []int{3, 4} {
+		b[200] = byte(n + 100)
+		copy(raw[n*cs:], b)
+		if err = w.Write(uint32(n), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = descriptor.Update(dir, func(dd *descriptor.Descriptor) error {
+		return dd.AddDelta(descriptor.NewGUID(), "top.hdd")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noAbort := func() error { return nil }
+	for _, toRaw := range []bool{true, false} {
+		if err = convertBase(dir, toRaw, noAbort); err != nil {
+			t.Fatalf("convertBase (raw %v): %s", toRaw, err)
+		}
+		dd, err := descriptor.Load(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range dd.Images {
+			if (i.Type == descriptor.TypeRaw) != toRaw || filepath.Ext(i.File) == newSuffix {
+				t.Errorf("unexpected image %+v (raw %v)", i, toRaw)
+			}
+		}
+		base, err := os.ReadFile(p.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, err := format.Open(p.File)
+		if err == nil {
+			i.Close()
+		}
+		if toRaw && (err == nil || len(base) != len(raw)) {
+			t.Errorf("expected a raw base delta of size %d, got %d (%v)", len(raw), len(base), err)
+		}
+		if !toRaw && err != nil {
+			t.Errorf("expected a ploop1 base delta: %s", err)
+		}
+
+		var out bytes.Buffer
+		if err = Export(dir, "", &out, StreamRaw); err != nil {
+			t.Fatalf("Export: %s", err)
+		}
+		if !bytes.Equal(out.Bytes(), raw) {
+			t.Errorf("data differs after conversion (raw %v)", toRaw)
+		}
+		if _, err = os.Stat(p.File + newSuffix); !os.IsNotExist(err) {
+			t.Errorf("temporary file is left: %v", err)
+		}
+	}
+
+	// an aborted conversion changes nothing
+	abort := func() error { return &Err{c: E_ABORT} }
+	if err = convertBase(dir, true, abort); !IsError(err, E_ABORT) {
+		t.Errorf("expected E_ABORT, got %v", err)
+	}
+	if i, err := format.Open(p.File); err != nil {
+		t.Errorf("expected a ploop1 base delta: %s", err)
+	} else {
+		i.Close()
+	}
+	if _, err = os.Stat(p.File + newSuffix); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+}
+
+func TestReplaceBase(t *testing.T) {
+	dir, newDir := t.TempDir(), t.TempDir()
+
+	// an "encrypted" image, and an unencrypted one with other data
+	const cs = 32 << 10
+	data := make([]byte, 8*cs)
+	p := CreateParam{File: filepath.Join(dir, DefaultFile), CLog: 6, Size: 8 * cs / 1024}
+	if err := Import(bytes.NewReader(data), StreamRaw, &p); err != nil {
+		t.Fatal(err)
+	}
+	err := descriptor.Update(dir, func(dd *descriptor.Descriptor) error {
+		dd.KeyID = "key-1"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[5*cs+1] = 1
+	np := CreateParam{File: filepath.Join(newDir, DefaultFile), CLog: 6, Size: 8 * cs / 1024}
+	if err = Import(bytes.NewReader(data), StreamRaw, &np); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = replaceBase(dir, np.File); err != nil {
+		t.Fatalf("replaceBase: %s", err)
+	}
+	if dd, err := descriptor.Load(dir); err != nil || dd.KeyID != "" {
+		t.Errorf("expected no key, got %+v (%v)", dd, err)
+	}
+	var out bytes.Buffer
+	if err = Export(dir, "", &out, StreamRaw); err != nil {
+		t.Fatalf("Export: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("data differs after replaceBase")
+	}
+	if _, err = os.Stat(np.File); !os.IsNotExist(err) {
+		t.Errorf("new image is not moved: %v", err)
+	}
+
+	// an image with snapshots can't be replaced
+	err = descriptor.Update(dir, func(dd *descriptor.Descriptor) error {
+		return dd.AddDelta(descriptor.NewGUID(), "top.hdd")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = replaceBase(dir, np.File); !IsError(err, E_PARAM) {
+		t.Errorf("replaceBase: expected E_PARAM, got %v", err)
+	}
+}
+
+// writes records offsets of copyData writes
+type writes []int64
+
+func (w *writes) WriteAt(b []byte, off int64) (int, error) {
+	*w = append(*w, off)
+	return len(b), nil
+}
+
+func TestCopyData(t *testing.T) {
+	src := make([]byte, 10)
+	src[4], src[9] = 1, 1
+	var w writes
+	if err := copyData(&w, bytes.NewReader(src), int64(len(src)), 4); err != nil {
+		t.Fatal(err)
+	}
+	// all-zero chunks are skipped, the last one is short
+	if len(w) != 2 || w[0] != 4 || w[1] != 8 {
+		t.Errorf("expected writes at 4 and 8, got %v", w)
+	}
+}
@@ -0,0 +1,225 @@
+package ploop
+
+import (
+	"io"
+	"os"
+)
+
+// #include <ploop/libploop.h>
+import "C"
+
+// DefaultCopyRounds is the default maximum number of CopySend
+// pre-copy iterations, not counting the initial full copy
+const DefaultCopyRounds = 10
+
+// CopyStat holds statistics of a single CopySend round
+type CopyStat struct {
+	Round        int    // round number, 0 is the initial full copy
+	Xferred      uint64 // bytes sent during this round
+	XferredTotal uint64 // bytes sent so far
+	Final        bool   // this is the final round, done after Freeze
+}
+
+// CopyParam is a set of parameters for CopySend()
+type CopyParam struct {
+	// MaxRounds is the maximum number of pre-copy iterations, done
+	// after the initial full copy. Zero means DefaultCopyRounds.
+	MaxRounds int
+	// Threshold is the amount of data (in bytes) sent during a round
+	// which is small enough to stop iterating and do the final round.
+	// Iterations also stop once the amount of data sent is not
+	// decreasing, i.e. the image is changed faster than it is sent.
+	Threshold uint64
+	// Freeze, if set, is called before the final round, for the caller
+	// to stop (or freeze) the container using the ploop, so that no
+	// more changes are made to the image. An error returned by Freeze
+	// aborts the copy. Freeze is called with no locks held.
+	Freeze func() error
+	// Progress, if set, is called after every round
+	Progress func(CopyStat)
+}
+
+// CopySend sends an image (the top delta) of a mounted ploop to w,
+// for CopyReceive on the other end to write it to a file. As the image
+// is in use, it is sent in rounds: the first round sends the whole
+// image, every next one sends the data changed during the previous
+// round, as found by the ploop kernel write tracker. Finally, p.Freeze
+// is called, and the remaining changes are sent.
+//
+// Statistics of all the rounds done are returned, even on error.
+func CopySend(d Ploop, w io.Writer, p *CopyParam) ([]CopyStat, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, &Err{c: E_SYS, s: err.Error()}
+	}
+
+	failed := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, pr)
+		if err != nil {
+			close(failed)
+			// drain the pipe so libploop does not block writing to it
+			io.Copy(io.Discard, pr)
+		}
+		pr.Close()
+		done <- err
+	}()
+
+	stats, err := d.copySend(pw, p, failed)
+	pw.Close()
+	if werr := <-done; werr != nil {
+		err = &Err{c: E_WRITE, s: werr.Error()}
+	}
+
+	return stats, err
+}
+
+func (d Ploop) copySend(pw *os.File, p *CopyParam, failed <-chan struct{}) ([]CopyStat, error) {
+	var a C.struct_ploop_copy_param
+	var h *C.struct_ploop_copy_handle
+
+	a.ofd = C.int(pw.Fd())
+	err := d.call(func(di *cDisk) C.int {
+		return C.ploop_copy_init(di, &a, &h)
+	})
+	if err != nil {
+		return nil, err
+	}
+	stopped := false
+	defer func() {
+		// both are done under the handle lock, as they use di,
+		// and are skipped if d is closed (and di is freed)
+		if !stopped {
+			// stop the write tracker
+			var cs C.struct_ploop_copy_stat
+			d.call(func(_ *cDisk) C.int {
+				return C.ploop_copy_stop(h, &cs)
+			})
+		}
+		d.call(func(_ *cDisk) C.int {
+			C.ploop_copy_deinit(h)
+			return 0
+		})
+	}()
+
+	var stats []CopyStat
+	round := func(fn func(*C.struct_ploop_copy_stat) C.int) error {
+		var cs C.struct_ploop_copy_stat
+		err := d.call(func(_ *cDisk) C.int {
+			return fn(&cs)
+		})
+		if err != nil {
+			return err
+		}
+		s := CopyStat{
+			Round:        len(stats),
+			Xferred:      uint64(cs.xferred),
+			XferredTotal: uint64(cs.xferred_total),
+		}
+		stats = append(stats, s)
+		if p.Progress != nil {
+			p.Progress(s)
+		}
+		select {
+		case <-failed:
+			// the error is reported by CopySend
+			return &Err{c: E_WRITE, s: "write error"}
+		default:
+		}
+		return nil
+	}
+
+	err = round(func(cs *C.struct_ploop_copy_stat) C.int {
+		return C.ploop_copy_start(h, cs)
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	rounds := p.MaxRounds
+	if rounds == 0 {
+		rounds = DefaultCopyRounds
+	}
+	for n := 1; n <= rounds; n++ {
+		prev := stats[len(stats)-1].Xferred
+		err = round(func(cs *C.struct_ploop_copy_stat) C.int {
+			return C.ploop_copy_next_iteration(h, cs)
+		})
+		if err != nil {
+			return stats, err
+		}
+		if x := stats[len(stats)-1].Xferred; x <= p.Threshold || (n > 1 && x >= prev) {
+			break
+		}
+	}
+
+	if p.Freeze != nil {
+		if err = p.Freeze(); err != nil {
+			return stats, err
+		}
+	}
+
+	err = round(func(cs *C.struct_ploop_copy_stat) C.int {
+		stopped = true
+		return C.ploop_copy_stop(h, cs)
+	})
+	if err == nil {
+		stats[len(stats)-1].Final = true
+	}
+
+	return stats, err
+}
+
+// CopyReceive receives an image sent by CopySend from r and writes
+// it to file. It returns once the whole image is received.
+//
+// The data is read from r in advance, so r should end right after
+// the image (e.g. be a connection dedicated for the transfer),
+// otherwise some data following the image might be consumed. Once
+// the image is received (or on error), r is closed, so that reading
+// from it stops.
+func CopyReceive(r io.ReadCloser, file string) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		r.Close()
+		return &Err{c: E_SYS, s: err.Error()}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(pw, r)
+		pw.Close()
+		done <- err
+	}()
+
+	var a C.struct_ploop_copy_receive_param
+	a.file = C.CString(file)
+	defer cfree(a.file)
+	a.ifd = C.int(pr.Fd())
+	a.feedback_fd = -1
+
+	err = call(func() C.int {
+		return C.ploop_copy_receiver(&a)
+	})
+
+	// a read error which happened before libploop returned
+	// most probably caused its failure, so report it
+	var rerr error
+	select {
+	case rerr = <-done:
+		done = nil
+	default:
+	}
+	// stop the reader and wait for it to finish
+	r.Close()
+	pr.Close()
+	if done != nil {
+		<-done
+	}
+	if err != nil && rerr != nil {
+		err = &Err{c: E_READ, s: rerr.Error()}
+	}
+
+	return err
+}
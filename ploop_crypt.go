@@ -0,0 +1,250 @@
+package ploop
+
+// Image encryption. An image only refers to its key by ID, and the
+// key is looked up by libploop's crypt helper (a program libploop runs)
+// whenever it is needed. libploop has no way to be given a key itself,
+// so keys from a KeyProvider are passed to the crypt helper through
+// a temporary directory named in its environment.
+
+import (
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+// #include <ploop/libploop.h>
+import "C"
+
+// Environment variables which libploop's crypt helper inherits if keys
+// are obtained from a KeyProvider, or a cipher is set. The helper should
+// read a key with a given ID from a file of the same name in KeyDirEnv,
+// if it is set, and use CipherEnv, if it is set, for a new encryption.
+const (
+	KeyDirEnv = "PLOOP_KEY_DIR" // directory with keys, laid out as FileKeys
+	CipherEnv = "PLOOP_CIPHER"  // cipher for a new encryption
+)
+
+// cryptEnv serializes the use of the process environment by withKeys
+var cryptEnv sync.Mutex
+
+// withKeys runs fn, a libploop call which might run the crypt helper,
+// providing it with keys with given IDs obtained from keys, and with
+// a cipher, if these are set (see KeyDirEnv and CipherEnv)
+func withKeys(keys KeyProvider, cipher string, ids []string, fn func() error) error {
+	if keys == nil && cipher == "" {
+		return fn()
+	}
+	cryptEnv.Lock()
+	defer cryptEnv.Unlock()
+
+	if keys != nil {
+		dir, remove, err := keyDir(keys, ids...)
+		if err != nil {
+			return err
+		}
+		defer remove()
+		os.Setenv(KeyDirEnv, dir)
+		defer os.Unsetenv(KeyDirEnv)
+	}
+	if cipher != "" {
+		os.Setenv(CipherEnv, cipher)
+		defer os.Unsetenv(CipherEnv)
+	}
+
+	return fn()
+}
+
+// KeyID returns the ID of a key an image is encrypted with,
+// or an empty string if the image is not encrypted
+func (d Ploop) KeyID() (string, error) {
+	var id string
+	err := d.do(func(_ *cDisk) error {
+		dd, err := descriptor.Load(d.h.file)
+		if err != nil {
+			return &Err{c: E_DISKDESCR, s: err.Error()}
+		}
+		id = dd.KeyID
+		return nil
+	})
+	return id, err
+}
+
+// Encrypt encrypts an unencrypted image (which should not be mounted)
+// with a key having a given ID. Unless p.Wipe is set, the unencrypted
+// data might be left in the unused parts of the image files.
+//
+// Only images with an ext file system (or with no file system) can be
+// encrypted, as the file system of an encrypted image can not be
+// looked into, and it is mounted by libploop.
+func (d Ploop) Encrypt(p *EncryptParam) error {
+	cur, err := d.KeyID()
+	if err != nil {
+		return err
+	}
+	if cur != "" {
+		return &Err{c: E_PARAM, s: "image is already encrypted, use RotateKey"}
+	}
+	fstype, err := imageFSType(d.h.file, "")
+	if err != nil {
+		return err
+	}
+	if fstype != "" && !isExt(fstype) {
+		return &Err{c: E_PARAM, s: "can't encrypt an image with " + fstype + " file system"}
+	}
+	return d.encrypt(p, "", 0)
+}
+
+// RotateKey re-encrypts an encrypted image (which should not be mounted)
+// with a new key having a given ID. The current key is obtained from
+// p.Keys as well.
+func (d Ploop) RotateKey(p *EncryptParam) error {
+	cur, err := d.KeyID()
+	if err != nil {
+		return err
+	}
+	if cur == "" {
+		return &Err{c: E_PARAM, s: "image is not encrypted, use Encrypt"}
+	}
+	if cur == p.KeyID {
+		return &Err{c: E_PARAM, s: "image is already encrypted with key " + cur}
+	}
+	return d.encrypt(p, cur, C.PLOOP_ENC_REENCRYPT)
+}
+
+func (d Ploop) encrypt(p *EncryptParam, oldID string, flags C.int) error {
+	if p.KeyID == "" {
+		return &Err{c: E_PARAM, s: "key ID is not set"}
+	}
+	var a C.struct_ploop_encrypt_param
+
+	a.keyid = C.CString(p.KeyID)
+	defer cfree(a.keyid)
+	if p.Wipe {
+		flags |= C.PLOOP_ENC_WIPE
+	}
+	a.flags = flags
+
+	ids := []string{p.KeyID}
+	if oldID != "" {
+		ids = append(ids, oldID)
+	}
+	return withKeys(p.Keys, p.Cipher, ids, func() error {
+		return d.callMeta(func(di *cDisk) C.int {
+			return C.ploop_encrypt_image(di, &a)
+		})
+	})
+}
+
+// Decrypt decrypts an encrypted image (which should not be mounted),
+// using a key obtained from keys (or looked up by the crypt helper, if
+// keys is nil). As libploop can't decrypt an image in place, the data is
+// copied from the ploop device to a new unencrypted image, which then
+// replaces the base delta, so there should be enough free space for a
+// copy of the image. Snapshots are encrypted as well, so an image with
+// snapshots can't be decrypted; merge them first.
+func (d Ploop) Decrypt(keys KeyProvider) error {
+	cur, err := d.KeyID()
+	if err != nil {
+		return err
+	}
+	if cur == "" {
+		return &Err{c: E_PARAM, s: "image is not encrypted"}
+	}
+	dd, err := descriptor.Load(d.h.file)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	if len(dd.Images) != 1 {
+		return &Err{c: E_PARAM, s: "can't decrypt an image with snapshots, merge them first"}
+	}
+	mode, err := d.Mode()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(dd.Dir(), ".decrypt")
+	if err != nil {
+		return &Err{c: E_SYS, s: err.Error()}
+	}
+	defer os.RemoveAll(tmp)
+	p := CreateParam{
+		Size:        dd.Size / 2,
+		Mode:        mode,
+		File:        filepath.Join(tmp, DefaultFile),
+		CLog:        uint(bits.TrailingZeros32(dd.BlockSize)),
+		NoFS:        true,
+		NoPartition: true,
+	}
+	if err = Create(&p); err != nil {
+		return err
+	}
+	if err = d.decryptTo(filepath.Join(tmp, descriptor.FileName), keys, int64(dd.BlockSize)*format.SectorSize); err != nil {
+		return err
+	}
+	if err = replaceBase(d.h.file, p.File); err != nil {
+		return err
+	}
+
+	// make libploop forget the key
+	return d.call(func(di *cDisk) C.int {
+		return C.ploop_read_dd(di)
+	})
+}
+
+// decryptTo copies the data of the encrypted ploop to an unencrypted
+// image of the same size with a given DiskDescriptor.xml, in chunks
+// of a given size, via their ploop devices
+func (d Ploop) decryptTo(file string, keys KeyProvider, chunk int64) (err error) {
+	nd, err := Open(file)
+	if err != nil {
+		return err
+	}
+	defer nd.Close()
+
+	from, err := d.Mount(&MountParam{Readonly: true, Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := d.Umount(); err == nil {
+			err = e
+		}
+	}()
+	to, err := nd.Mount(&MountParam{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := nd.Umount(); err == nil {
+			err = e
+		}
+	}()
+
+	src, err := os.Open(from)
+	if err != nil {
+		return &Err{c: E_OPEN, s: err.Error()}
+	}
+	defer src.Close()
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &Err{c: E_READ, s: err.Error()}
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY, 0)
+	if err != nil {
+		return &Err{c: E_OPEN, s: err.Error()}
+	}
+	defer dst.Close()
+
+	if err = copyData(dst, src, size, chunk); err != nil {
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		return &Err{c: E_WRITE, s: err.Error()}
+	}
+	return nil
+}
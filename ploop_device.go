@@ -0,0 +1,230 @@
+package ploop
+
+// Information about running ploop devices, from sysfs, in pure Go
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kolyshkin/goploop/descriptor"
+)
+
+// DeltaInfo holds information about a delta attached to a ploop device
+type DeltaInfo struct {
+	File     string // delta image file
+	Format   string // delta format, "ploop1" or "raw"
+	IO       string // kernel I/O engine used, e.g. "direct" or "kaio"
+	ReadOnly bool   // delta is read-only
+}
+
+// DeviceInfo holds information about a running ploop device
+type DeviceInfo struct {
+	Device     string      // ploop device, e.g. /dev/ploop12345
+	Partition  string      // device with the inner file system, e.g. /dev/ploop12345p1
+	MountPoint string      // where the inner file system is mounted, if it is
+	Deltas     []DeltaInfo // deltas attached, base delta first
+	Descriptor string      // DiskDescriptor.xml next to the base delta, if any
+}
+
+// Top returns the top delta, or nil if there are no deltas
+func (i *DeviceInfo) Top() *DeltaInfo {
+	if len(i.Deltas) == 0 {
+		return nil
+	}
+	return &i.Deltas[len(i.Deltas)-1]
+}
+
+// sysfs describes where to get information about ploop devices from,
+// so that it can be faked in tests
+type sysfs struct {
+	root      string // sysfs mount point
+	mountinfo string // mountinfo file
+}
+
+var defaultSysfs = sysfs{root: "/sys", mountinfo: "/proc/self/mountinfo"}
+
+// ListDevices returns information about all running ploop devices
+// (i.e. the ones with deltas attached), sorted by device name
+func ListDevices() ([]DeviceInfo, error) {
+	return defaultSysfs.list()
+}
+
+// FindByDevice returns information about a running ploop device,
+// given as either a device (/dev/ploopN), its partition (/dev/ploopNp1),
+// or a device name (ploopN). If the device is not running, an error
+// for which IsNotMounted() is true is returned.
+func FindByDevice(dev string) (DeviceInfo, error) {
+	return defaultSysfs.find(dev)
+}
+
+// findByTopDelta returns information about a running ploop device
+// with a given top delta file
+func findByTopDelta(file string) (DeviceInfo, error) {
+	devs, err := ListDevices()
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	// the kernel reports real paths
+	if real, err := filepath.EvalSymlinks(file); err == nil {
+		file = real
+	}
+	for _, d := range devs {
+		if d.Top().File == file {
+			return d, nil
+		}
+	}
+	return DeviceInfo{}, &Err{c: E_DEV_NOT_MOUNTED, s: "no ploop device with top delta " + file}
+}
+
+func (s sysfs) list() ([]DeviceInfo, error) {
+	names, err := filepath.Glob(filepath.Join(s.root, "block", "ploop*"))
+	if err != nil {
+		return nil, &Err{c: E_SYSFS, s: err.Error()}
+	}
+	sort.Strings(names)
+
+	mounts, err := s.mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []DeviceInfo
+	for _, n := range names {
+		i, err := s.device(filepath.Base(n), mounts)
+		if err != nil {
+			return nil, err
+		}
+		if len(i.Deltas) != 0 {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret, nil
+}
+
+func (s sysfs) find(dev string) (DeviceInfo, error) {
+	name := filepath.Base(dev)
+	if n := strings.TrimSuffix(name, "p1"); n != name && strings.HasPrefix(n, "ploop") {
+		name = n
+	}
+	if !strings.HasPrefix(name, "ploop") {
+		return DeviceInfo{}, &Err{c: E_PARAM, s: dev + " is not a ploop device"}
+	}
+
+	mounts, err := s.mounts()
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	i, err := s.device(name, mounts)
+	if err == nil && len(i.Deltas) == 0 {
+		err = &Err{c: E_DEV_NOT_MOUNTED, s: "device " + i.Device + " is not running"}
+	}
+
+	return i, err
+}
+
+// device reads information about a ploop device with a given name,
+// mounts is a map of device numbers to mount points
+func (s sysfs) device(name string, mounts map[string]string) (DeviceInfo, error) {
+	i := DeviceInfo{Device: "/dev/" + name, Partition: "/dev/" + name}
+	dir := filepath.Join(s.root, "block", name)
+
+	if _, err := os.Stat(dir); err != nil {
+		return i, &Err{c: E_DEV_NOT_MOUNTED, s: "no such device " + i.Device}
+	}
+	devnum := readSysfs(filepath.Join(dir, "dev"))
+	if n := readSysfs(filepath.Join(dir, name+"p1", "dev")); n != "" {
+		i.Partition += "p1"
+		devnum = n
+	}
+	i.MountPoint = mounts[devnum]
+
+	levels, err := filepath.Glob(filepath.Join(dir, "pdelta", "*"))
+	if err != nil {
+		return i, &Err{c: E_SYSFS, s: err.Error()}
+	}
+	sort.Slice(levels, func(a, b int) bool {
+		la, _ := strconv.Atoi(filepath.Base(levels[a]))
+		lb, _ := strconv.Atoi(filepath.Base(levels[b]))
+		return la < lb
+	})
+	for _, l := range levels {
+		i.Deltas = append(i.Deltas, DeltaInfo{
+			File:     readSysfs(filepath.Join(l, "image")),
+			Format:   readSysfs(filepath.Join(l, "format")),
+			IO:       readSysfs(filepath.Join(l, "io")),
+			ReadOnly: readSysfs(filepath.Join(l, "ro")) == "1",
+		})
+	}
+
+	if len(i.Deltas) != 0 {
+		dd := filepath.Join(filepath.Dir(i.Deltas[0].File), descriptor.FileName)
+		if _, err := os.Stat(dd); err == nil {
+			i.Descriptor = dd
+		}
+	}
+
+	return i, nil
+}
+
+// readSysfs returns the contents of a sysfs file, or
+// an empty string if it can not be read
+func readSysfs(file string) string {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// mounts parses mountinfo, returning a map of
+// device numbers (as in "major:minor") to mount points
+func (s sysfs) mounts() (map[string]string, error) {
+	f, err := os.Open(s.mountinfo)
+	if err != nil {
+		return nil, &Err{c: E_OPEN, s: err.Error()}
+	}
+	defer f.Close()
+
+	ret := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if _, ok := ret[fields[2]]; !ok {
+			ret[fields[2]] = unescapeMount(fields[4])
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, &Err{c: E_READ, s: err.Error()}
+	}
+
+	return ret, nil
+}
+
+// unescapeMount decodes octal escapes (such as \040 for a space)
+// used in mountinfo fields
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for n := 0; n < len(s); n++ {
+		if s[n] == '\\' && n+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[n+1:n+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				n += 3
+				continue
+			}
+		}
+		b.WriteByte(s[n])
+	}
+	return b.String()
+}
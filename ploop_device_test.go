@@ -0,0 +1,95 @@
+package ploop
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mkfile writes a file, creating parent directories as needed
+func mkfile(t *testing.T, file, data string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeSysfs(t *testing.T) sysfs {
+	dir := t.TempDir()
+	s := sysfs{root: filepath.Join(dir, "sys"), mountinfo: filepath.Join(dir, "mountinfo")}
+	img := filepath.Join(dir, "ct")
+	mkfile(t, filepath.Join(img, "DiskDescriptor.xml"), "")
+
+	// a running device with two deltas and a partition
+	b := filepath.Join(s.root, "block", "ploop12345")
+	mkfile(t, filepath.Join(b, "dev"), "182:197520\n")
+	mkfile(t, filepath.Join(b, "ploop12345p1", "dev"), "182:197521\n")
+	for l, d := range []struct{ image, ro string }{
+		{img + "/root.hdd", "1"},
+		{img + "/root.hdd.{1234}", "0"},
+	} {
+		p := filepath.Join(b, "pdelta", string(rune('0'+l)))
+		mkfile(t, filepath.Join(p, "image"), d.image+"\n")
+		mkfile(t, filepath.Join(p, "format"), "ploop1\n")
+		mkfile(t, filepath.Join(p, "io"), "direct\n")
+		mkfile(t, filepath.Join(p, "ro"), d.ro+"\n")
+	}
+	// a device which is not running
+	mkfile(t, filepath.Join(s.root, "block", "ploop7", "dev"), "182:112\n")
+	if err := os.MkdirAll(filepath.Join(s.root, "block", "ploop7", "pdelta"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// not a ploop device
+	mkfile(t, filepath.Join(s.root, "block", "sda", "dev"), "8:0\n")
+
+	mkfile(t, s.mountinfo,
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+			"95 22 182:197521 / /vz/root/my\\040ct rw,relatime shared:50 - ext4 /dev/ploop12345p1 rw\n")
+
+	return s
+}
+
+func TestListDevices(t *testing.T) {
+	s := fakeSysfs(t)
+
+	devs, err := s.list()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(devs) != 1 {
+		t.Fatalf("list: expected 1 device, got %+v", devs)
+	}
+	d := devs[0]
+	if d.Device != "/dev/ploop12345" || d.Partition != "/dev/ploop12345p1" ||
+		d.MountPoint != "/vz/root/my ct" {
+		t.Errorf("list: bad device info %+v", d)
+	}
+	if len(d.Deltas) != 2 || !d.Deltas[0].ReadOnly || d.Top().ReadOnly ||
+		d.Top().IO != "direct" || d.Top().Format != "ploop1" {
+		t.Errorf("list: bad deltas %+v", d.Deltas)
+	}
+	if filepath.Base(d.Descriptor) != "DiskDescriptor.xml" {
+		t.Errorf("list: descriptor not found")
+	}
+}
+
+func TestFindByDevice(t *testing.T) {
+	s := fakeSysfs(t)
+
+	for _, dev := range []string{"/dev/ploop12345", "/dev/ploop12345p1", "ploop12345"} {
+		d, err := s.find(dev)
+		if err != nil || d.Device != "/dev/ploop12345" {
+			t.Errorf("find(%s): %+v, %v", dev, d, err)
+		}
+	}
+	for _, dev := range []string{"/dev/ploop7", "/dev/ploop1"} {
+		if _, err := s.find(dev); !IsNotMounted(err) {
+			t.Errorf("find(%s): expected not mounted error, got %v", dev, err)
+		}
+	}
+	if _, err := s.find("/dev/sda"); !IsError(err, E_PARAM) {
+		t.Errorf("find(/dev/sda): expected E_PARAM, got %v", err)
+	}
+}
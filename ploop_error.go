@@ -1,8 +1,11 @@
 package ploop
 
-// #include <ploop/libploop.h>
-import "C"
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
 
 // Err contains a ploop error
 type Err struct {
@@ -105,6 +108,62 @@ var ErrCodes = []string{
 	E_NOSNAP:          "E_NOSNAP",
 }
 
+// Sentinel errors, one per ploop error code, to be used with errors.Is().
+// Any *Err with the same code matches the corresponding sentinel, e.g.
+//
+//	if errors.Is(err, ploop.ErrNoSnap) { ... }
+var (
+	ErrCreat      = &Err{c: E_CREAT}
+	ErrDevice     = &Err{c: E_DEVICE}
+	ErrDevIoc     = &Err{c: E_DEVIOC}
+	ErrOpen       = &Err{c: E_OPEN}
+	ErrMalloc     = &Err{c: E_MALLOC}
+	ErrRead       = &Err{c: E_READ}
+	ErrWrite      = &Err{c: E_WRITE}
+	ErrSysfs      = &Err{c: E_SYSFS}
+	ErrPloopFmt   = &Err{c: E_PLOOPFMT}
+	ErrSys        = &Err{c: E_SYS}
+	ErrProtocol   = &Err{c: E_PROTOCOL}
+	ErrLoop       = &Err{c: E_LOOP}
+	ErrFstat      = &Err{c: E_FSTAT}
+	ErrFsync      = &Err{c: E_FSYNC}
+	ErrBusy       = &Err{c: E_EBUSY}
+	ErrFlock      = &Err{c: E_FLOCK}
+	ErrFtruncate  = &Err{c: E_FTRUNCATE}
+	ErrFallocate  = &Err{c: E_FALLOCATE}
+	ErrMount      = &Err{c: E_MOUNT}
+	ErrUmount     = &Err{c: E_UMOUNT}
+	ErrLock       = &Err{c: E_LOCK}
+	ErrMkfs       = &Err{c: E_MKFS}
+	ErrResizeFS   = &Err{c: E_RESIZE_FS}
+	ErrMkdir      = &Err{c: E_MKDIR}
+	ErrRename     = &Err{c: E_RENAME}
+	ErrAbort      = &Err{c: E_ABORT}
+	ErrReloc      = &Err{c: E_RELOC}
+	ErrChangeGPT  = &Err{c: E_CHANGE_GPT}
+	ErrUnlink     = &Err{c: E_UNLINK}
+	ErrMknod      = &Err{c: E_MKNOD}
+	ErrInUse      = &Err{c: E_PLOOPINUSE}
+	ErrParam      = &Err{c: E_PARAM}
+	ErrDiskDescr  = &Err{c: E_DISKDESCR}
+	ErrNotMounted = &Err{c: E_DEV_NOT_MOUNTED}
+	ErrFsck       = &Err{c: E_FSCK}
+	ErrNoSnap     = &Err{c: E_NOSNAP}
+)
+
+// ErrClosed is returned when a closed (or never opened) Ploop is used
+var ErrClosed = errors.New("ploop: disk descriptor is closed")
+
+// errMap maps ploop error codes to standard errors
+// they are equivalent to, as reported by Is()
+var errMap = map[int][]error{
+	E_MALLOC:     {syscall.ENOMEM},
+	E_EBUSY:      {syscall.EBUSY},
+	E_PLOOPINUSE: {syscall.EBUSY},
+	E_PARAM:      {syscall.EINVAL, os.ErrInvalid},
+	E_NOSNAP:     {os.ErrNotExist},
+}
+
 // Error returns a string representation of a ploop error
 func (e *Err) Error() string {
 	s := "E_UNKNOWN"
@@ -112,13 +171,38 @@ func (e *Err) Error() string {
 		s = ErrCodes[e.c]
 	}
 
+	if e.s == "" {
+		return fmt.Sprintf("ploop error %d (%s)", e.c, s)
+	}
 	return fmt.Sprintf("ploop error %d (%s): %s", e.c, s, e.s)
 }
 
-// IsError checks if an error is a specific ploop error
+// Code returns a ploop error code, i.e. one of E_* constants
+func (e *Err) Code() int {
+	return e.c
+}
+
+// Is reports whether an error matches target, for errors.Is().
+// A ploop error matches any other ploop error with the same code
+// (including sentinels such as ErrNoSnap), and some codes also match
+// standard errors, e.g. E_EBUSY matches syscall.EBUSY, and E_PARAM
+// matches syscall.EINVAL and os.ErrInvalid.
+func (e *Err) Is(target error) bool {
+	if t, ok := target.(*Err); ok {
+		return e.c == t.c
+	}
+	for _, err := range errMap[e.c] {
+		if err == target {
+			return true
+		}
+	}
+	return false
+}
+
+// IsError checks if an error is (or wraps) a specific ploop error
 func IsError(err error, code int) bool {
-	perr, ok := err.(*Err)
-	return ok && perr.c == code
+	var perr *Err
+	return errors.As(err, &perr) && perr.c == code
 }
 
 // IsNotMounted returns true if an error is ploop "device is not mounted"
@@ -126,10 +210,8 @@ func IsNotMounted(err error) bool {
 	return IsError(err, E_DEV_NOT_MOUNTED)
 }
 
-func mkerr(ret C.int) error {
-	if ret == 0 {
-		return nil
-	}
-
-	return &Err{c: int(ret), s: C.GoString(C.ploop_get_last_error())}
+// NewError creates a ploop error with a given code and message.
+// It is mostly useful for Backend implementations other than libploop.
+func NewError(code int, msg string) error {
+	return &Err{c: code, s: msg}
 }
@@ -0,0 +1,57 @@
+package ploop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", NewError(E_NOSNAP, "no such snapshot"))
+
+	if !errors.Is(err, ErrNoSnap) {
+		t.Errorf("errors.Is(%v, ErrNoSnap) is false", err)
+	}
+	if errors.Is(err, ErrParam) {
+		t.Errorf("errors.Is(%v, ErrParam) is true", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("errors.Is(%v, os.ErrNotExist) is false", err)
+	}
+	if !IsError(err, E_NOSNAP) {
+		t.Errorf("IsError(%v, E_NOSNAP) is false", err)
+	}
+
+	var perr *Err
+	if !errors.As(err, &perr) || perr.Code() != E_NOSNAP {
+		t.Errorf("errors.As(%v): bad result", err)
+	}
+}
+
+func TestErrorsIsSyscall(t *testing.T) {
+	for code, target := range map[int]error{
+		E_EBUSY:      syscall.EBUSY,
+		E_PLOOPINUSE: syscall.EBUSY,
+		E_PARAM:      syscall.EINVAL,
+		E_MALLOC:     syscall.ENOMEM,
+	} {
+		err := fmt.Errorf("wrapped: %w", NewError(code, ""))
+		if !errors.Is(err, target) {
+			t.Errorf("errors.Is(%v, %v) is false", err, target)
+		}
+	}
+	if errors.Is(NewError(E_SYS, ""), syscall.EBUSY) {
+		t.Errorf("E_SYS should not match EBUSY")
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	if s := ErrNoSnap.Error(); s != "ploop error 43 (E_NOSNAP)" {
+		t.Errorf("unexpected sentinel error string %q", s)
+	}
+	if s := NewError(E_PARAM, "bad").Error(); s != "ploop error 38 (E_PARAM): bad" {
+		t.Errorf("unexpected error string %q", s)
+	}
+}
@@ -0,0 +1,354 @@
+package ploop
+
+// Export and import of ploop images to/from flat disk image
+// streams, in pure Go (no libploop or ploop kernel module needed)
+
+import (
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+	"github.com/kolyshkin/goploop/qcow2"
+)
+
+// StreamFormat is a format of a flat disk image for Export and Import
+type StreamFormat int
+
+// Possible StreamFormat values
+const (
+	StreamRaw   StreamFormat = iota // raw disk image, as read from a block device
+	StreamQcow2                     // sparse qcow2 image, as used by QEMU
+)
+
+// String converts a StreamFormat value to string
+func (f StreamFormat) String() string {
+	switch f {
+	case StreamRaw:
+		return "raw"
+	case StreamQcow2:
+		return "qcow2"
+	}
+	return "<unknown>"
+}
+
+// Export writes the contents of a ploop virtual disk, as seen from
+// a snapshot with a given uuid (or from the top delta, if uuid is empty),
+// to w, as a single flattened disk image in a given format. For every
+// cluster, the data is taken from the topmost delta which has it.
+//
+// path is either a DiskDescriptor.xml or a directory containing it.
+// Deltas are read directly, so the image should not be in use; to export
+// a mounted ploop, create a snapshot and export it instead. Encrypted
+// images can not be exported.
+func Export(path, uuid string, w io.Writer, f StreamFormat) error {
+	c, err := openChain(path, uuid)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if c.inUse() {
+		return &Err{c: E_PLOOPINUSE, s: "image is in use, export a snapshot instead"}
+	}
+
+	switch f {
+	case StreamRaw:
+		return exportRaw(c, w)
+	case StreamQcow2:
+		return exportQcow2(c, w)
+	}
+	return &Err{c: E_PARAM, s: "unknown stream format"}
+}
+
+func exportRaw(c *chain, w io.Writer) error {
+	b := make([]byte, c.clusterBytes)
+	left := int64(c.size)
+
+	for n := uint32(0); n < c.clusters(); n++ {
+		if err := c.readCluster(n, b); err != nil {
+			return err
+		}
+		chunk := min(left, c.clusterBytes)
+		if _, err := w.Write(b[:chunk]); err != nil {
+			return &Err{c: E_WRITE, s: err.Error()}
+		}
+		left -= chunk
+	}
+
+	return nil
+}
+
+func exportQcow2(c *chain, w io.Writer) error {
+	// qcow2 clusters can be smaller than ploop ones, if so,
+	// each ploop cluster is stored as a few qcow2 clusters
+	pbits := uint32(bits.TrailingZeros64(uint64(c.clusterBytes)))
+	qbits := min(pbits, qcow2.MaxClusterBits)
+	if qbits < qcow2.MinClusterBits {
+		return &Err{c: E_PARAM, s: "cluster size is too small for qcow2"}
+	}
+	shift := pbits - qbits
+	total := (c.size + 1<<qbits - 1) >> qbits
+
+	var list []uint64
+	for _, n := range c.allocated() {
+		for k := uint64(0); k < 1<<shift; k++ {
+			if q := uint64(n)<<shift + k; q < total {
+				list = append(list, q)
+			}
+		}
+	}
+
+	b := make([]byte, c.clusterBytes)
+	last := int64(-1) // ploop cluster currently in b
+	err := qcow2.Write(w, c.size, qbits, list, func(q uint64, qb []byte) error {
+		if n := int64(q >> shift); n != last {
+			if err := c.readCluster(uint32(n), b); err != nil {
+				return err
+			}
+			last = n
+		}
+		copy(qb, b[(q&(1<<shift-1))<<qbits:])
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(*Err); !ok {
+			err = &Err{c: E_WRITE, s: err.Error()}
+		}
+	}
+
+	return err
+}
+
+// Import creates a new expanded ploop image and its DiskDescriptor.xml
+// (in the same directory) from a flattened disk image in a given format,
+// read from r. Image file name and cluster block size are taken from p,
+// with the same defaults Create uses. If p.Size is not set, the size of
+// the disk image is used, which, for a raw stream, requires r to be a file.
+// Clusters containing only zeroes are not allocated in the new image.
+//
+// Reading qcow2 requires random access, so if r is not an io.ReaderAt,
+// it is copied to a temporary file next to the new image first.
+func Import(r io.Reader, f StreamFormat, p *CreateParam) error {
+	if p.Mode != Expanded {
+		return &Err{c: E_PARAM, s: "only expanded images can be imported"}
+	}
+	if p.File == "" {
+		p.File = DefaultFile
+	}
+	clog := p.CLog
+	if clog == 0 {
+		clog = DefaultCLog
+	}
+	if clog < 6 || clog > 15 {
+		return &Err{c: E_PARAM, s: "cluster block size log should be from 6 to 15"}
+	}
+	blockSize := uint32(1) << clog
+	ddFile := filepath.Join(filepath.Dir(p.File), descriptor.FileName)
+	if _, err := os.Stat(ddFile); err == nil {
+		return &Err{c: E_CREAT, s: ddFile + " already exists"}
+	}
+
+	var err error
+	switch f {
+	case StreamRaw:
+		err = importRaw(r, p, blockSize)
+	case StreamQcow2:
+		err = importQcow2(r, p, blockSize)
+	default:
+		return &Err{c: E_PARAM, s: "unknown stream format"}
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := format.Open(p.File)
+	if err != nil {
+		os.Remove(p.File)
+		return &Err{c: E_PLOOPFMT, s: err.Error()}
+	}
+	dd := descriptor.New(info.DiskSize, blockSize, filepath.Base(p.File))
+	info.Close()
+	if err = dd.Save(ddFile); err != nil {
+		os.Remove(p.File)
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+
+	return nil
+}
+
+// importSize returns the new image size, in sectors, given
+// the size of a source disk image (in bytes, or 0 if unknown)
+func importSize(p *CreateParam, size int64) (uint64, error) {
+	sectors := (uint64(size) + format.SectorSize - 1) / format.SectorSize
+	if p.Size != 0 {
+		if p.Size*2 < sectors {
+			return 0, &Err{c: E_PARAM, s: "image size is smaller than that of the source image"}
+		}
+		sectors = p.Size * 2
+	}
+	if sectors == 0 {
+		return 0, &Err{c: E_PARAM, s: "image size is not set"}
+	}
+	return sectors, nil
+}
+
+// writeImage creates a new ploop image of a given size and block size
+// (both in sectors), calling read to obtain the data of each virtual
+// cluster in clusters (or every cluster, if clusters is nil) in order.
+// If sparse is set, all-zero clusters are skipped (which should not be
+// done for an upper delta, as it would expose the data below). The image
+// is removed on error.
+func writeImage(file string, size uint64, blockSize uint32, clusters []uint32, sparse bool,
+	read func(cluster uint32, b []byte) error) (err error) {
+	w, err := format.Create(file, size, blockSize)
+	if err != nil {
+		return &Err{c: E_CREAT, s: err.Error()}
+	}
+	defer func() {
+		if err != nil {
+			w.File().Close()
+			os.Remove(file)
+		}
+	}()
+
+	if clusters == nil {
+		clusters = make([]uint32, w.Clusters)
+		for n := range clusters {
+			clusters[n] = uint32(n)
+		}
+	}
+	b := make([]byte, w.ClusterBytes())
+	for _, n := range clusters {
+		if n >= w.Clusters {
+			break
+		}
+		if err = read(n, b); err != nil {
+			return err
+		}
+		if sparse && isZero(b) {
+			continue
+		}
+		if err = w.Write(n, b); err != nil {
+			return &Err{c: E_WRITE, s: err.Error()}
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return &Err{c: E_WRITE, s: err.Error()}
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func importRaw(r io.Reader, p *CreateParam, blockSize uint32) error {
+	var size int64
+	if p.Size == 0 {
+		st, ok := r.(interface{ Stat() (os.FileInfo, error) })
+		if !ok {
+			return &Err{c: E_PARAM, s: "image size is required to import a raw stream"}
+		}
+		fi, err := st.Stat()
+		if err != nil {
+			return &Err{c: E_FSTAT, s: err.Error()}
+		}
+		size = fi.Size()
+	}
+	sectors, err := importSize(p, size)
+	if err != nil {
+		return err
+	}
+
+	eof := false
+	err = writeImage(p.File, sectors, blockSize, nil, true, func(_ uint32, b []byte) error {
+		if eof {
+			clear(b)
+			return nil
+		}
+		n, err := io.ReadFull(r, b)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			clear(b[n:])
+			eof, err = true, nil
+		}
+		if err != nil {
+			return &Err{c: E_READ, s: err.Error()}
+		}
+		return nil
+	})
+	if err != nil || eof {
+		return err
+	}
+
+	// make sure nothing is left in the stream
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		os.Remove(p.File)
+		return &Err{c: E_PARAM, s: "image size is smaller than that of the source image"}
+	}
+	return nil
+}
+
+func importQcow2(r io.Reader, p *CreateParam, blockSize uint32) error {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		tmp, err := os.CreateTemp(filepath.Dir(p.File), ".import-*.qcow2")
+		if err != nil {
+			return &Err{c: E_CREAT, s: err.Error()}
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err = io.Copy(tmp, r); err != nil {
+			return &Err{c: E_WRITE, s: err.Error()}
+		}
+		ra = tmp
+	}
+
+	q, err := qcow2.Open(ra)
+	if err != nil {
+		return &Err{c: E_PLOOPFMT, s: err.Error()}
+	}
+	sectors, err := importSize(p, int64(q.Size))
+	if err != nil {
+		return err
+	}
+
+	// find out which ploop clusters have any data
+	pcs := int64(blockSize) * format.SectorSize
+	qcs := q.ClusterBytes()
+	var list []uint32
+	err = q.Walk(func(c uint64, _ int64) error {
+		from := uint32(int64(c) * qcs / pcs)
+		to := uint32((int64(c+1)*qcs - 1) / pcs)
+		if len(list) != 0 && list[len(list)-1] >= from {
+			from = list[len(list)-1] + 1
+		}
+		for n := from; n <= to; n++ {
+			list = append(list, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return &Err{c: E_READ, s: err.Error()}
+	}
+
+	return writeImage(p.File, sectors, blockSize, list, true, func(c uint32, b []byte) error {
+		n, err := q.ReadAt(b, int64(c)*pcs)
+		if err == io.EOF {
+			clear(b[n:])
+			err = nil
+		}
+		if err != nil {
+			return &Err{c: E_READ, s: err.Error()}
+		}
+		return nil
+	})
+}
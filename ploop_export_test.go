@@ -0,0 +1,97 @@
+package ploop
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolyshkin/goploop/format"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+
+	// 40 clusters of 32K, with data in every third one, last one partial
+	const cs = 32 << 10
+	raw := make([]byte, 40*cs-4096)
+	for n := 0; n < 40; n += 3 {
+		raw[n*cs+100] = byte(n + 1)
+	}
+	rawFile := filepath.Join(dir, "disk.raw")
+	if err := os.WriteFile(rawFile, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, clog := range []uint{6, 13} {
+		src := filepath.Join(dir, "src")
+		dst := filepath.Join(dir, "dst")
+		for _, d := range []string{src, dst} {
+			os.RemoveAll(d)
+			if err := os.Mkdir(d, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := os.Open(rawFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := CreateParam{File: filepath.Join(src, DefaultFile), CLog: clog}
+		err = Import(f, StreamRaw, &p)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Import raw (clog %d): %s", clog, err)
+		}
+		if clog == 6 {
+			i, err := format.Open(p.File)
+			if err != nil {
+				t.Fatalf("format.Open: %s", err)
+			}
+			if i.Allocated() != 14 {
+				t.Errorf("Import raw: expected 14 allocated clusters, got %d", i.Allocated())
+			}
+			i.Close()
+		}
+
+		var out bytes.Buffer
+		if err = Export(src, "", &out, StreamRaw); err != nil {
+			t.Fatalf("Export raw (clog %d): %s", clog, err)
+		}
+		if !bytes.Equal(out.Bytes(), raw) {
+			t.Errorf("Export raw (clog %d): data differs", clog)
+		}
+
+		// reimport via qcow2, with a different cluster size, from
+		// a reader which is not io.ReaderAt (i.e. via a temp file)
+		var q bytes.Buffer
+		if err = Export(src, "", &q, StreamQcow2); err != nil {
+			t.Fatalf("Export qcow2 (clog %d): %s", clog, err)
+		}
+		p = CreateParam{File: filepath.Join(dst, "img.hdd")}
+		if err = Import(io.MultiReader(&q), StreamQcow2, &p); err != nil {
+			t.Fatalf("Import qcow2 (clog %d): %s", clog, err)
+		}
+		out.Reset()
+		if err = Export(dst, "", &out, StreamRaw); err != nil {
+			t.Fatalf("Export raw (clog %d): %s", clog, err)
+		}
+		if !bytes.Equal(out.Bytes(), raw) {
+			t.Errorf("Export raw after qcow2 (clog %d): data differs", clog)
+		}
+		if e, _ := filepath.Glob(filepath.Join(dst, ".import-*")); len(e) != 0 {
+			t.Errorf("Import qcow2: temporary file left behind")
+		}
+	}
+
+	// raw stream of unknown size
+	p := CreateParam{File: filepath.Join(dir, "src", "x.hdd")}
+	if err := Import(bytes.NewReader(raw), StreamRaw, &p); !IsError(err, E_CREAT) {
+		t.Errorf("Import: expected E_CREAT for existing descriptor, got %v", err)
+	}
+	p.File = filepath.Join(dir, "x.hdd")
+	if err := Import(bytes.NewReader(raw), StreamRaw, &p); !IsError(err, E_PARAM) {
+		t.Errorf("Import: expected E_PARAM for unknown size, got %v", err)
+	}
+}
@@ -0,0 +1,403 @@
+package ploop
+
+// Inner file system helpers, in pure Go
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kolyshkin/goploop/descriptor"
+)
+
+// isExt returns true for file system types handled by libploop
+func isExt(fstype string) bool {
+	return fstype == "ext4" || fstype == "ext3"
+}
+
+// readBlock reads n bytes at off from r, zero-filling anything past EOF
+func readBlock(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// partitionOffset returns the byte offset of the first partition of a
+// disk with a GPT partition table, or 0 if there is no partition table
+func partitionOffset(r io.ReaderAt) (int64, error) {
+	const sector = 512
+	le := binary.LittleEndian
+
+	h, err := readBlock(r, sector, sector)
+	if err != nil {
+		return 0, err
+	}
+	if string(h[:8]) != "EFI PART" {
+		return 0, nil
+	}
+	e, err := readBlock(r, int64(le.Uint64(h[72:]))*sector, 128)
+	if err != nil {
+		return 0, err
+	}
+	return int64(le.Uint64(e[32:])) * sector, nil
+}
+
+// GPT layout used for new images: a single partition, aligned to 1M
+const (
+	gptEntries    = 128 // number of partition entries
+	gptEntrySize  = 128 // size of a partition entry, in bytes
+	gptTableLBAs  = gptEntries * gptEntrySize / 512
+	gptPartStart  = 2048 // first partition sector
+	gptPartAlign  = 2048 // partition end alignment, in sectors
+	gptMinSectors = gptPartStart + gptPartAlign + gptTableLBAs + 1
+)
+
+// gptLinuxFS is the "Linux file system data" partition type GUID
+// (0FC63DAF-8483-4772-8E79-3D69D8477DE4), in its on-disk byte order
+var gptLinuxFS = []byte{
+	0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47,
+	0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4,
+}
+
+// randomGUID returns a new random (version 4) GUID, in its on-disk byte order
+func randomGUID() []byte {
+	g := make([]byte, 16)
+	rand.Read(g)
+	g[7] = g[7]&0x0f | 0x40 // version, the 3rd field is little endian
+	g[8] = g[8]&0x3f | 0x80 // variant
+	return g
+}
+
+// gpt creates a GPT partition table for a disk of a given size
+// (in sectors), with a single partition for a Linux file system.
+// It returns the contents of the first and the last sectors of the
+// disk (protective MBR, primary GPT and backup GPT), and the partition
+// location (first sector and size, in sectors).
+func gpt(sectors uint64) (head, tail []byte, start, size uint64) {
+	return gptLayout(sectors, randomGUID(), randomGUID())
+}
+
+// gptLayout is gpt with given disk and partition GUIDs
+func gptLayout(sectors uint64, disk, part []byte) (head, tail []byte, start, size uint64) {
+	const sector = 512
+	le := binary.LittleEndian
+	last := sectors - 1
+	lastUsable := last - gptTableLBAs - 1
+	end := (lastUsable+1)/gptPartAlign*gptPartAlign - 1
+
+	// protective MBR
+	head = make([]byte, (2+gptTableLBAs)*sector)
+	mbr := head[446:]
+	mbr[4] = 0xee
+	le.PutUint32(mbr[8:], 1)
+	le.PutUint32(mbr[12:], uint32(min(last, 0xffffffff)))
+	le.PutUint16(head[510:], 0xaa55)
+
+	// partition entries, the same for the primary and the backup GPT
+	table := head[2*sector:]
+	copy(table, gptLinuxFS)
+	copy(table[16:], part)
+	le.PutUint64(table[32:], gptPartStart)
+	le.PutUint64(table[40:], end)
+	for n, c := range "Linux filesystem" {
+		le.PutUint16(table[56+2*n:], uint16(c))
+	}
+
+	copy(head[sector:], gptHeader(1, last, lastUsable, disk, table))
+	tail = gptTail(last, lastUsable, disk, table)
+
+	return head, tail, gptPartStart, end - gptPartStart + 1
+}
+
+// gptHeader returns a GPT header located at LBA cur, with the other
+// copy at LBA backup, for a given partition entries table
+func gptHeader(cur, backup, lastUsable uint64, disk, table []byte) []byte {
+	le := binary.LittleEndian
+	entries := uint64(2)
+	if cur > backup {
+		entries = cur - gptTableLBAs
+	}
+
+	h := make([]byte, 512)
+	copy(h, "EFI PART")
+	le.PutUint32(h[8:], 0x00010000) // revision 1.0
+	le.PutUint32(h[12:], 92)        // header size
+	le.PutUint64(h[24:], cur)
+	le.PutUint64(h[32:], backup)
+	le.PutUint64(h[40:], 2+gptTableLBAs) // first usable LBA
+	le.PutUint64(h[48:], lastUsable)
+	copy(h[56:], disk)
+	le.PutUint64(h[72:], entries)
+	le.PutUint32(h[80:], gptEntries)
+	le.PutUint32(h[84:], gptEntrySize)
+	le.PutUint32(h[88:], crc32.ChecksumIEEE(table))
+	le.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+	return h
+}
+
+// gptTail returns the backup GPT (partition entries and header),
+// to be written to the last sectors of a disk
+func gptTail(last, lastUsable uint64, disk, table []byte) []byte {
+	const sector = 512
+	tail := make([]byte, (gptTableLBAs+1)*sector)
+	copy(tail, table[:gptTableLBAs*sector])
+	copy(tail[gptTableLBAs*sector:], gptHeader(last, 1, lastUsable, disk, table))
+	return tail
+}
+
+// partInfo is what sgdisk reports about a partition
+type partInfo struct {
+	start string // first sector
+	typ   string // type GUID
+	guid  string // unique GUID
+	name  string
+}
+
+// parsePartInfo parses the output of sgdisk -i
+func parsePartInfo(out string) (partInfo, error) {
+	var p partInfo
+	for _, l := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		first, _, _ := strings.Cut(v, " ")
+		switch k {
+		case "First sector":
+			p.start = first
+		case "Partition GUID code":
+			p.typ = first
+		case "Partition unique GUID":
+			p.guid = first
+		case "Partition name":
+			p.name = strings.Trim(v, "'")
+		}
+	}
+	if p.start == "" || p.typ == "" || p.guid == "" {
+		return p, &Err{c: E_CHANGE_GPT, s: "can't get partition info: " + strings.TrimSpace(out)}
+	}
+	return p, nil
+}
+
+// growPartition grows the first partition of a disk up to its end, by
+// running sgdisk, which moves the backup GPT to the end of the disk and
+// re-creates the partition with the same start, type, GUID and name,
+// writing both GPTs at once. As the partition might be in use (e.g.
+// mounted), the kernel is then told about its new size by partx.
+func growPartition(dev string) error {
+	run := func(cmd string, args ...string) (string, error) {
+		out, err := exec.Command(cmd, args...).CombinedOutput()
+		if err != nil {
+			return "", &Err{c: E_CHANGE_GPT, s: fmt.Sprintf("%s %s: %s: %s", cmd, dev, err, out)}
+		}
+		return string(out), nil
+	}
+
+	out, err := run("sgdisk", "-i", "1", dev)
+	if err != nil {
+		return err
+	}
+	p, err := parsePartInfo(out)
+	if err != nil {
+		return err
+	}
+	args := []string{"-e", "-d", "1", "-n", "1:" + p.start + ":0", "-t", "1:" + p.typ, "-u", "1:" + p.guid}
+	if p.name != "" {
+		args = append(args, "-c", "1:"+p.name)
+	}
+	if _, err = run("sgdisk", append(args, dev)...); err != nil {
+		return err
+	}
+	_, err = run("partx", "-u", "--nr", "1", dev)
+
+	return err
+}
+
+// growFS grows the inner file system of a mounted ploop device (and its
+// partition, if there is one) to fill the whole device, by running
+// resize2fs, xfs_growfs or btrfs, depending on the file system type
+func growFS(i DeviceInfo) error {
+	if i.MountPoint == "" {
+		return &Err{c: E_DEV_NOT_MOUNTED, s: "file system on " + i.Partition + " is not mounted"}
+	}
+
+	if i.Partition != i.Device {
+		if err := growPartition(i.Device); err != nil {
+			return err
+		}
+	}
+
+	p, err := os.Open(i.Partition)
+	if err != nil {
+		return &Err{c: E_OPEN, s: err.Error()}
+	}
+	fstype, err := fsType(p)
+	p.Close()
+	if err != nil {
+		return &Err{c: E_READ, s: err.Error()}
+	}
+
+	var cmd []string
+	switch {
+	case isExt(fstype):
+		cmd = []string{"resize2fs", i.Partition}
+	case fstype == "xfs":
+		cmd = []string{"xfs_growfs", i.MountPoint}
+	case fstype == "btrfs":
+		cmd = []string{"btrfs", "filesystem", "resize", "max", i.MountPoint}
+	default:
+		return &Err{c: E_PARAM, s: "unknown file system on " + i.Partition}
+	}
+	if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		return &Err{c: E_RESIZE_FS, s: fmt.Sprintf("%s: %s: %s", cmd[0], err, out)}
+	}
+
+	return nil
+}
+
+// fsType detects the type of the inner file system of a ploop virtual
+// disk, by looking at its superblock. It returns an empty string if
+// there is no file system (or its type is not known).
+func fsType(r io.ReaderAt) (string, error) {
+	off, err := partitionOffset(r)
+	if err != nil {
+		return "", err
+	}
+	le := binary.LittleEndian
+
+	sb, err := readBlock(r, off, 2048)
+	if err != nil {
+		return "", err
+	}
+	if string(sb[:4]) == "XFSB" {
+		return "xfs", nil
+	}
+	if ext := sb[1024:]; le.Uint16(ext[56:]) == 0xEF53 {
+		compat, incompat := le.Uint32(ext[92:]), le.Uint32(ext[96:])
+		switch {
+		case incompat&(0x40|0x80|0x200) != 0: // extents, 64bit, flex_bg
+			return "ext4", nil
+		case compat&0x4 != 0: // has_journal
+			return "ext3", nil
+		}
+		return "ext2", nil
+	}
+
+	sb, err = readBlock(r, off+65536+64, 8)
+	if err != nil {
+		return "", err
+	}
+	if string(sb) == "_BHRfS_M" {
+		return "btrfs", nil
+	}
+
+	return "", nil
+}
+
+// imageFSType detects the type of the inner file system of a ploop
+// image (as seen from a snapshot with a given uuid, or the top delta).
+// Encrypted images can not be looked into, but only libploop can create
+// a file system on those (see Create), so DefaultFSType is returned.
+func imageFSType(path, uuid string) (string, error) {
+	dd, err := descriptor.Load(path)
+	if err != nil {
+		return "", &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	if dd.KeyID != "" {
+		return DefaultFSType, nil
+	}
+
+	r, err := OpenChainReader(path, uuid)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	t, err := fsType(r)
+	if err != nil {
+		return "", &Err{c: E_READ, s: err.Error()}
+	}
+	return t, nil
+}
+
+// waitDevice waits for a newly created device node (e.g. a partition)
+// to appear, letting udev finish processing its events first
+func waitDevice(dev string, timeout time.Duration) error {
+	// udevadm might be not available, in which case just poll
+	exec.Command("udevadm", "settle", "--timeout="+strconv.Itoa(int(timeout.Seconds()))).Run()
+
+	for end := time.Now().Add(timeout); ; time.Sleep(100 * time.Millisecond) {
+		if _, err := os.Stat(dev); err == nil {
+			return nil
+		}
+		if time.Now().After(end) {
+			return &Err{c: E_SYS, s: "timeout waiting for " + dev + " to appear"}
+		}
+	}
+}
+
+// mkfsArgs returns arguments for mkfs.<fstype> to create
+// a file system on dev according to p
+func mkfsArgs(p *CreateParam, fstype, dev string) ([]string, error) {
+	var args []string
+
+	if p.FSLabel != "" {
+		args = append(args, "-L", p.FSLabel)
+	}
+	if p.InodeRatio != 0 {
+		if !strings.HasPrefix(fstype, "ext") {
+			return nil, &Err{c: E_PARAM, s: "inode ratio is only supported for ext file systems"}
+		}
+		args = append(args, "-i", strconv.FormatUint(uint64(p.InodeRatio), 10))
+	}
+	args = append(args, p.MkfsOptions...)
+	args = append(args, dev)
+
+	return args, nil
+}
+
+// mountedFSInfo returns information about the inner file system
+// of a mounted ploop with a given descriptor, using statfs(2)
+func mountedFSInfo(file string) (FSInfoData, error) {
+	var info FSInfoData
+
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if real, err := filepath.EvalSymlinks(file); err == nil {
+		file = real
+	}
+	devs, err := ListDevices()
+	if err != nil {
+		return info, err
+	}
+	for _, d := range devs {
+		if d.Descriptor != file || d.MountPoint == "" {
+			continue
+		}
+		var st syscall.Statfs_t
+		if err = syscall.Statfs(d.MountPoint, &st); err != nil {
+			return info, &Err{c: E_SYS, s: err.Error()}
+		}
+		info.BlockSize = uint64(st.Bsize)
+		info.Blocks = st.Blocks
+		info.BlocksFree = st.Bfree
+		info.Inodes = st.Files
+		info.InodesFree = st.Ffree
+		return info, nil
+	}
+
+	return info, &Err{c: E_DEV_NOT_MOUNTED, s: "file system is not mounted"}
+}
@@ -0,0 +1,168 @@
+package ploop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mkdisk returns a disk image with an optional GPT partition table
+// (with a single partition at 1M), and a file system superblock
+// magic put at a given offset from the partition start
+func mkdisk(gpt bool, off int, magic []byte) []byte {
+	b := make([]byte, 2<<20)
+	le := binary.LittleEndian
+	start := 0
+	if gpt {
+		copy(b[512:], "EFI PART")
+		le.PutUint64(b[512+72:], 2) // partition entries LBA
+		le.PutUint64(b[1024+32:], 2048)
+		start = 1 << 20
+	}
+	copy(b[start+off:], magic)
+	return b
+}
+
+func TestFSType(t *testing.T) {
+	ext := func(compat, incompat uint32) []byte {
+		sb := make([]byte, 100)
+		binary.LittleEndian.PutUint16(sb[56:], 0xEF53)
+		binary.LittleEndian.PutUint32(sb[92:], compat)
+		binary.LittleEndian.PutUint32(sb[96:], incompat)
+		return sb
+	}
+
+	for _, tc := range []struct {
+		name string
+		disk []byte
+		fs   string
+	}{
+		{"empty", mkdisk(true, 0, nil), ""},
+		{"ext4", mkdisk(true, 1024, ext(0x4, 0x40)), "ext4"},
+		{"ext3", mkdisk(false, 1024, ext(0x4, 0)), "ext3"},
+		{"ext2", mkdisk(true, 1024, ext(0, 0)), "ext2"},
+		{"xfs", mkdisk(true, 0, []byte("XFSB")), "xfs"},
+		{"xfs-nopart", mkdisk(false, 0, []byte("XFSB")), "xfs"},
+		{"btrfs", mkdisk(false, 65536+64, []byte("_BHRfS_M")), "btrfs"},
+		{"short", []byte("XFSB"), "xfs"},
+	} {
+		fs, err := fsType(bytes.NewReader(tc.disk))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if fs != tc.fs {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.fs, fs)
+		}
+	}
+}
+
+func TestMkfsArgs(t *testing.T) {
+	p := CreateParam{FSLabel: "data", InodeRatio: 65536, MkfsOptions: []string{"-q"}}
+	args, err := mkfsArgs(&p, "ext4", "/dev/ploop1p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"-L", "data", "-i", "65536", "-q", "/dev/ploop1p1"}
+	if !reflect.DeepEqual(args, exp) {
+		t.Errorf("expected %q, got %q", exp, args)
+	}
+
+	if _, err = mkfsArgs(&p, "xfs", "/dev/ploop1p1"); !IsError(err, E_PARAM) {
+		t.Errorf("expected E_PARAM, got %v", err)
+	}
+}
+
+func TestWaitDevice(t *testing.T) {
+	dir := t.TempDir()
+	if err := waitDevice(dir, time.Second); err != nil {
+		t.Errorf("existing: %s", err)
+	}
+	if err := waitDevice(filepath.Join(dir, "none"), 0); !IsError(err, E_SYS) {
+		t.Errorf("missing: expected E_SYS, got %v", err)
+	}
+}
+
+func TestGrowPartition(t *testing.T) {
+	// sgdisk and partx replacements, logging their arguments,
+	// and failing if told to via the environment
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	info := `Partition GUID code: 0FC63DAF-8483-4772-8E79-3D69D8477DE4 (Linux filesystem)
+Partition unique GUID: 5D0B6F21-2C6B-4A0E-9C5B-2E7A3A1D9F10
+First sector: 2048 (at 1024.0 KiB)
+Last sector: 30719 (at 15.0 MiB)
+Partition size: 28672 sectors (14.0 MiB)
+Attribute flags: 0000000000000000
+Partition name: 'primary'
+`
+	for _, cmd := range []string{"sgdisk", "partx"} {
+		script := fmt.Sprintf(`#!/bin/sh
+echo %[1]s "$@" >> %[2]s
+[ "$1" = -i ] && cat %[2]s.info
+[ -z "$FAIL" ] || [ "$FAIL" != "$1" ] || { echo failed; exit 1; }
+`, cmd, log)
+		if err := os.WriteFile(filepath.Join(dir, cmd), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(log+".info", []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, tc := range []struct {
+		fail string // first argument of a failing command
+		exp  []string
+	}{
+		{"", []string{
+			"sgdisk -i 1 /dev/ploop1",
+			"sgdisk -e -d 1 -n 1:2048:0 -t 1:0FC63DAF-8483-4772-8E79-3D69D8477DE4 -u 1:5D0B6F21-2C6B-4A0E-9C5B-2E7A3A1D9F10 -c 1:primary /dev/ploop1",
+			"partx -u --nr 1 /dev/ploop1",
+		}},
+		// partx is not run if the partition table is not changed
+		{"-e", []string{
+			"sgdisk -i 1 /dev/ploop1",
+			"sgdisk -e -d 1 -n 1:2048:0 -t 1:0FC63DAF-8483-4772-8E79-3D69D8477DE4 -u 1:5D0B6F21-2C6B-4A0E-9C5B-2E7A3A1D9F10 -c 1:primary /dev/ploop1",
+		}},
+		{"-u", []string{
+			"sgdisk -i 1 /dev/ploop1",
+			"sgdisk -e -d 1 -n 1:2048:0 -t 1:0FC63DAF-8483-4772-8E79-3D69D8477DE4 -u 1:5D0B6F21-2C6B-4A0E-9C5B-2E7A3A1D9F10 -c 1:primary /dev/ploop1",
+			"partx -u --nr 1 /dev/ploop1",
+		}},
+	} {
+		os.Remove(log)
+		t.Setenv("FAIL", tc.fail)
+		err := growPartition("/dev/ploop1")
+		if tc.fail == "" && err != nil {
+			t.Errorf("growPartition: %s", err)
+		}
+		if tc.fail != "" && !IsError(err, E_CHANGE_GPT) {
+			t.Errorf("growPartition (%s failing): expected E_CHANGE_GPT, got %v", tc.fail, err)
+		}
+		b, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := strings.Split(strings.TrimSpace(string(b)), "\n"); !reflect.DeepEqual(l, tc.exp) {
+			t.Errorf("expected commands %q, got %q", tc.exp, l)
+		}
+	}
+
+	// no partition, nothing is changed
+	if err := os.WriteFile(log+".info", []byte("Partition #1 does not exist.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(log)
+	t.Setenv("FAIL", "")
+	if err := growPartition("/dev/ploop1"); !IsError(err, E_CHANGE_GPT) {
+		t.Errorf("growPartition: expected E_CHANGE_GPT, got %v", err)
+	}
+	if b, _ := os.ReadFile(log); strings.TrimSpace(string(b)) != "sgdisk -i 1 /dev/ploop1" {
+		t.Errorf("unexpected commands %q", b)
+	}
+}
@@ -0,0 +1,97 @@
+package ploop
+
+// Encryption key providers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyProvider looks up encryption keys of ploop images by key IDs
+type KeyProvider interface {
+	// Key returns the key with a given ID
+	Key(id string) ([]byte, error)
+}
+
+// FileKeys is a KeyProvider which stores keys in a directory,
+// one file per key, named after the key ID
+type FileKeys string
+
+// checkKeyID makes sure a key ID can be used as a file name
+func checkKeyID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsRune(id, filepath.Separator) {
+		return &Err{c: E_PARAM, s: "bad key ID " + id}
+	}
+	return nil
+}
+
+// Key reads the key with a given ID
+func (k FileKeys) Key(id string) ([]byte, error) {
+	if err := checkKeyID(id); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(string(k), id))
+	if err != nil {
+		return nil, &Err{c: E_OPEN, s: err.Error()}
+	}
+	if len(b) == 0 {
+		return nil, &Err{c: E_PARAM, s: "empty key " + id}
+	}
+	return b, nil
+}
+
+// Put saves a key with a given ID, readable by the owner only
+func (k FileKeys) Put(id string, key []byte) error {
+	if err := checkKeyID(id); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(string(k), id), key, 0600); err != nil {
+		return &Err{c: E_WRITE, s: err.Error()}
+	}
+	return nil
+}
+
+// keyDir copies keys with given IDs from keys to a new temporary
+// directory, laid out as FileKeys, for the crypt helper to read them.
+// The returned function wipes and removes the directory.
+func keyDir(keys KeyProvider, ids ...string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "ploop-keys")
+	if err != nil {
+		return "", nil, &Err{c: E_SYS, s: err.Error()}
+	}
+	remove := func() {
+		ents, _ := os.ReadDir(dir)
+		for _, e := range ents {
+			file := filepath.Join(dir, e.Name())
+			if fi, err := e.Info(); err == nil {
+				os.WriteFile(file, make([]byte, fi.Size()), 0600)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+
+	for _, id := range ids {
+		if err = checkKeyID(id); err != nil {
+			break
+		}
+		var b []byte
+		if b, err = keys.Key(id); err != nil {
+			if _, ok := err.(*Err); !ok {
+				err = &Err{c: E_PARAM, s: "can't get key " + id + ": " + err.Error()}
+			}
+			break
+		}
+		err = FileKeys(dir).Put(id, b)
+		clear(b)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	return dir, remove, nil
+}
@@ -0,0 +1,42 @@
+package ploop
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestFileKeys(t *testing.T) {
+	k := FileKeys(t.TempDir())
+
+	if err := k.Put("key-1", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := k.Key("key-1"); err != nil || !bytes.Equal(b, []byte("secret")) {
+		t.Errorf("Key: got %q (%v)", b, err)
+	}
+	if _, err := k.Key("key-2"); !IsError(err, E_OPEN) {
+		t.Errorf("Key: expected E_OPEN for a missing key, got %v", err)
+	}
+	for _, id := range []string{"", "..", "a/b"} {
+		if err := k.Put(id, []byte("x")); !IsError(err, E_PARAM) {
+			t.Errorf("Put(%q): expected E_PARAM, got %v", id, err)
+		}
+	}
+
+	dir, remove, err := keyDir(k, "key-1")
+	if err != nil {
+		t.Fatalf("keyDir: %s", err)
+	}
+	if b, err := FileKeys(dir).Key("key-1"); err != nil || !bytes.Equal(b, []byte("secret")) {
+		t.Errorf("keyDir: got %q (%v)", b, err)
+	}
+	remove()
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("keyDir: %s not removed (%v)", dir, err)
+	}
+
+	if _, _, err = keyDir(k, "key-1", "key-2"); !IsError(err, E_OPEN) {
+		t.Errorf("keyDir: expected E_OPEN for a missing key, got %v", err)
+	}
+}
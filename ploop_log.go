@@ -0,0 +1,128 @@
+package ploop
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// #include <ploop/libploop.h>
+import "C"
+
+// libploop log file timestamp format
+const logTimeFormat = "2006-01-02T15:04:05-0700"
+
+var logger struct {
+	sync.Mutex
+	w    *os.File      // write end of the pipe given to libploop
+	done chan struct{} // closed when reader goroutine exits
+}
+
+// SetLogHandler routes all libploop log messages to a slog.Handler h,
+// with a given libploop log level (verbosity, 0 to 4). Every message is
+// passed to h as a separate record, with the timestamp set by libploop.
+//
+// libploop does not write message levels to its log, so the slog level
+// is guessed from the message text: messages starting with "Error" are
+// logged with slog.LevelError, ones starting with "Warning" (or
+// "WARNING") with slog.LevelWarn, and everything else, including errors
+// and warnings worded differently, with slog.LevelInfo.
+//
+// Internally, this works by setting libploop log file to a pipe, so it
+// can not be used together with SetLogFile. Use SetVerboseLevel(NoConsole)
+// to also disable libploop logging to stdout/stderr. Call SetLogHandler
+// with nil h to stop routing and close the pipe.
+func SetLogHandler(h slog.Handler, level int) error {
+	logger.Lock()
+	defer logger.Unlock()
+
+	if logger.w != nil {
+		// make libploop close its end of the pipe
+		C.ploop_set_log_file(nil)
+		logger.w.Close()
+		<-logger.done
+		logger.w = nil
+	}
+	if h == nil {
+		return nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// libploop opens the log file itself, so give it a path
+	cfile := C.CString(fmt.Sprintf("/proc/self/fd/%d", w.Fd()))
+	defer cfree(cfile)
+
+	err = call(func() C.int {
+		return C.ploop_set_log_file(cfile)
+	})
+	if err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+	C.ploop_set_log_level(C.int(level))
+
+	logger.w = w
+	logger.done = make(chan struct{})
+	go readLog(r, h, logger.done)
+
+	return nil
+}
+
+// readLog reads libploop log lines from r and passes them to h
+func readLog(r io.ReadCloser, h slog.Handler, done chan struct{}) {
+	defer close(done)
+	defer r.Close()
+
+	ctx := context.Background()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if s.Text() == "" {
+			continue
+		}
+		t, level, msg := parseLogLine(s.Text())
+		if !h.Enabled(ctx, level) {
+			continue
+		}
+		rec := slog.NewRecord(t, level, msg, 0)
+		rec.AddAttrs(slog.String("component", "libploop"))
+		h.Handle(ctx, rec)
+	}
+}
+
+// parseLogLine parses a libploop log file line, which looks like
+//
+//	2015-10-05T16:02:14+0300 Error: message
+//
+// If there is no timestamp, current time is used.
+func parseLogLine(line string) (time.Time, slog.Level, string) {
+	t := time.Now()
+	msg := line
+
+	if sp := strings.IndexByte(line, ' '); sp > 0 {
+		ts := strings.Trim(line[:sp], "[]:")
+		if pt, err := time.Parse(logTimeFormat, ts); err == nil {
+			t = pt
+			msg = line[sp+1:]
+		}
+	}
+
+	level := slog.LevelInfo
+	switch {
+	case strings.HasPrefix(msg, "Error:"), strings.HasPrefix(msg, "Error "):
+		level = slog.LevelError
+	case strings.HasPrefix(msg, "Warning:"), strings.HasPrefix(msg, "WARNING:"):
+		level = slog.LevelWarn
+	}
+
+	return t, level, msg
+}
@@ -0,0 +1,35 @@
+//go:build cgo
+
+package ploop
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLogParse(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		line  string
+		level slog.Level
+		msg   string
+		ts    bool
+	}{
+		{"2015-10-05T16:02:14+0300 Adding delta dev=/dev/ploop1", slog.LevelInfo, "Adding delta dev=/dev/ploop1", true},
+		{"2015-10-05T16:02:14+0300 Error: can't open file", slog.LevelError, "Error: can't open file", true},
+		{"[2015-10-05T16:02:14+0300] Warning: something", slog.LevelWarn, "Warning: something", true},
+		{"no timestamp here", slog.LevelInfo, "no timestamp here", false},
+	} {
+		ts, level, msg := parseLogLine(tc.line)
+		if level != tc.level || msg != tc.msg {
+			t.Errorf("%q: got %v %q", tc.line, level, msg)
+		}
+		if tc.ts && !ts.Equal(time.Date(2015, 10, 5, 13, 2, 14, 0, time.UTC)) {
+			t.Errorf("%q: bad timestamp %v", tc.line, ts)
+		}
+		if !tc.ts && ts.Before(now) {
+			t.Errorf("%q: expected current time, got %v", tc.line, ts)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package ploop
+
+import "context"
+
+// #include <ploop/libploop.h>
+import "C"
+
+// MergeParam is a set of parameters for Merge(). At most one of UUID,
+// All, or a level range (FromLevel and ToLevel) should be set; if none
+// is set, the top delta is merged down into its parent.
+type MergeParam struct {
+	UUID string // snapshot to merge down into its parent
+	All  bool   // merge all deltas down into the base delta
+	// FromLevel and ToLevel define a range of deltas (levels are
+	// counted from 0, which is the base delta) to merge: deltas on
+	// levels from FromLevel+1 to ToLevel are merged down into FromLevel.
+	FromLevel int
+	ToLevel   int
+	NewDelta  string // optional new file name for the resulting delta
+	// Progress, if set, is called to report the merge progress. For
+	// a level range merged by this package (see Merge), a step is
+	// a cluster written, otherwise, there is only one step.
+	Progress func(step, steps int)
+}
+
+// Merge merges snapshots, online (if ploop is mounted) or offline,
+// in one pass.
+//
+// A single snapshot, or all deltas at once, are merged by libploop.
+// So is a level range of a single delta, or the whole chain. As
+// libploop can't merge any other range of deltas in one pass, it
+// is merged by this package, by writing the data of all the deltas
+// in the range to a new delta, and replacing them with it in
+// DiskDescriptor.xml at once. This requires the ploop to be unmounted.
+// The resulting delta keeps the uuid of level ToLevel (as the snapshots
+// above it refer to it), and the file name of level FromLevel (unless
+// NewDelta is set). Deltas in the range (except the top one) should
+// not have other child snapshots.
+func (d Ploop) Merge(p *MergeParam) error {
+	return d.MergeContext(context.Background(), p)
+}
+
+// MergeContext is the same as Merge, but can be cancelled via ctx.
+// A cancelled merge leaves the image as it was. See runContext
+// for details.
+func (d Ploop) MergeContext(ctx context.Context, p *MergeParam) error {
+	isRange := p.FromLevel != 0 || p.ToLevel != 0
+	if (p.UUID != "" && p.All) || (isRange && (p.UUID != "" || p.All)) {
+		return &Err{c: E_PARAM, s: "only one of UUID, All, or level range can be specified"}
+	}
+	if !isRange {
+		return d.merge(ctx, p.UUID, p.All, p.NewDelta, p.Progress)
+	}
+
+	s, err := d.Snapshots()
+	if err != nil {
+		return err
+	}
+	chain := chainUUIDs(s)
+	top := len(chain) - 1
+	switch {
+	case p.FromLevel < 0 || p.FromLevel >= p.ToLevel || p.ToLevel > top:
+		return &Err{c: E_PARAM, s: "invalid level range"}
+	case p.FromLevel == 0 && p.ToLevel == top:
+		return d.merge(ctx, "", true, p.NewDelta, p.Progress)
+	case p.ToLevel == p.FromLevel+1:
+		return d.merge(ctx, chain[p.ToLevel], false, p.NewDelta, p.Progress)
+	}
+
+	return d.runContext(ctx, func(d Ploop) error {
+		return d.doMeta(func(di *cDisk, _ snapMeta) error {
+			switch C.ploop_is_mounted(di) {
+			case 0:
+			case 1:
+				return &Err{c: E_PARAM, s: "a range of deltas can only be merged offline"}
+			default:
+				return mkerr(E_SYS)
+			}
+			err := mergeRange(d.h.file, p.FromLevel, p.ToLevel, p.NewDelta, p.Progress, d.aborted)
+			if ret := C.ploop_read_dd(di); err == nil && ret != 0 {
+				err = mkerr(ret)
+			}
+			return err
+		})
+	})
+}
+
+// merge calls ploop_merge_snapshot
+func (d Ploop) merge(ctx context.Context, uuid string, all bool, newDelta string, progress func(step, steps int)) error {
+	var a C.struct_ploop_merge_param
+
+	a.merge_all = boolToC(all)
+	if uuid != "" {
+		cuuid := C.CString(uuid)
+		defer cfree(cuuid)
+		a.guid = cuuid
+	}
+	if newDelta != "" {
+		cdelta := C.CString(newDelta)
+		defer cfree(cdelta)
+		a.new_delta = cdelta
+	}
+
+	err := d.runContext(ctx, func(d Ploop) error {
+		return d.callMeta(func(di *cDisk) C.int {
+			return C.ploop_merge_snapshot(di, &a)
+		})
+	})
+	if err == nil && progress != nil {
+		progress(1, 1)
+	}
+
+	return err
+}
@@ -0,0 +1,137 @@
+package ploop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+// mergeRange merges deltas on levels from+1 to to of the current chain
+// of a ploop (path is either a DiskDescriptor.xml or a directory
+// containing it) down into level from, in one pass: the data of all
+// these deltas is written to a new delta file, which then replaces them
+// all in the descriptor at once. The resulting delta keeps the GUID of
+// level to (which is what its children refer to), and the file name of
+// level from, or newDelta, if set. The image should not be in use.
+//
+// progress, if set, is called after every cluster written, and abort
+// before it; if abort returns an error, the merge is stopped, leaving
+// the image as it was.
+func mergeRange(path string, from, to int, newDelta string,
+	progress func(step, steps int), abort func() error) error {
+	unlock, err := descriptor.Lock(path)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	defer unlock()
+
+	dd, err := descriptor.Load(path)
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	if dd.KeyID != "" {
+		return &Err{c: E_PARAM, s: "image is encrypted"}
+	}
+	images, err := dd.Chain("")
+	if err != nil {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+	top := len(images) - 1
+	if from < 0 || from >= to || to > top {
+		return &Err{c: E_PARAM, s: "invalid level range"}
+	}
+
+	// levels from to to, base delta first
+	var guids, files []string
+	for l := from; l <= to; l++ {
+		i := images[top-l]
+		if l < to && len(dd.Children(i.GUID)) != 1 {
+			// other snapshots depend on the data of this delta
+			return &Err{c: E_PARAM, s: fmt.Sprintf("snapshot %s has more than one child", i.GUID)}
+		}
+		guids = append(guids, i.GUID)
+		files = append(files, dd.ImagePath(i))
+	}
+	raw := from == 0 && images[top].Type == descriptor.TypeRaw
+	name := images[top-from].File
+
+	deltas := make([]string, 0, len(files))
+	for n := len(files) - 1; n >= 0; n-- {
+		deltas = append(deltas, files[n])
+	}
+	c, err := openDeltas(deltas, raw, dd.Size*format.SectorSize, int64(dd.BlockSize)*format.SectorSize)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if c.inUse() {
+		return &Err{c: E_PLOOPINUSE, s: "image is in use"}
+	}
+
+	out := files[0] + newSuffix
+	if newDelta != "" {
+		if out, err = filepath.Abs(newDelta); err != nil {
+			return &Err{c: E_PARAM, s: err.Error()}
+		}
+	} else {
+		// a leftover of an interrupted merge, not used by the descriptor
+		os.Remove(out)
+	}
+
+	step, steps := 0, len(c.allocated())
+	next := func() error {
+		if err := abort(); err != nil {
+			return err
+		}
+		if step > 0 && progress != nil {
+			progress(step, steps)
+		}
+		step++
+		return nil
+	}
+	if raw {
+		err = writeRaw(out, c, next)
+	} else {
+		err = writeDelta(out, c, dd.Size, dd.BlockSize, from == 0, next)
+	}
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(steps, steps)
+	}
+
+	update := func() {
+		// the children are re-parented, so level to ends up
+		// being a child of what was the parent of level from
+		for n := len(guids) - 2; n >= 0; n-- {
+			dd.RemoveDelta(guids[n])
+		}
+	}
+	keep := ""
+	if newDelta == "" {
+		err = installImage(path, dd, guids[len(guids)-1], name, update)
+		keep = files[0]
+	} else {
+		update()
+		dd.Image(guids[len(guids)-1]).File = out
+		if err = dd.Save(path); err != nil {
+			os.Remove(out)
+			err = &Err{c: E_DISKDESCR, s: err.Error()}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f != keep {
+			os.Remove(f)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package ploop
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+// addDelta adds a new top delta to a ploop in dir, with given clusters
+// filled with a given byte, also applying the change to disk
+func addDelta(t *testing.T, dir, name string, clusters map[int]byte, disk []byte) string {
+	const cs = 32 << 10
+	w, err := format.Create(filepath.Join(dir, name), uint64(len(disk)/512), cs/512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, v := range clusters {
+		b := bytes.Repeat([]byte{v}, cs)
+		copy(disk[n*cs:], b)
+		if err = w.Write(uint32(n), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the current top delta becomes a snapshot with a new GUID
+	guid := descriptor.NewGUID()
+	err = descriptor.Update(dir, func(dd *descriptor.Descriptor) error {
+		return dd.AddDelta(guid, name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guid
+}
+
+func TestMergeRange(t *testing.T) {
+	const cs = 32 << 10
+	setup := func() (string, []byte, []string) {
+		dir := t.TempDir()
+		disk := make([]byte, 16*cs)
+		for n := 0; n < 16; n += 2 {
+			disk[n*cs] = byte(n + 1)
+		}
+		p := CreateParam{File: filepath.Join(dir, DefaultFile), CLog: 6, Size: 16 * cs / 1024}
+		if err := Import(bytes.NewReader(disk), StreamRaw, &p); err != nil {
+			t.Fatal(err)
+		}
+		guids := []string{descriptor.TopDeltaGUID,
+			addDelta(t, dir, "d1", map[int]byte{1: 0x11, 2: 0x12}, disk),
+			// zeroes hide the data of cluster 2 below
+			addDelta(t, dir, "d2", map[int]byte{2: 0, 3: 0x23}, disk),
+			addDelta(t, dir, "d3", map[int]byte{5: 0x35}, disk),
+		}
+		return dir, disk, guids
+	}
+	check := func(dir string, disk []byte, chain []string) {
+		t.Helper()
+		dd, err := descriptor.Load(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := dd.Chain("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) != len(chain) {
+			t.Fatalf("expected %d deltas, got %d", len(chain), len(c))
+		}
+		for n, i := range c {
+			if i.GUID != chain[len(chain)-1-n] {
+				t.Errorf("level %d: expected %s, got %s", len(chain)-1-n, chain[len(chain)-1-n], i.GUID)
+			}
+		}
+		var out bytes.Buffer
+		if err = Export(dir, "", &out, StreamRaw); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), disk) {
+			t.Errorf("data differs")
+		}
+	}
+	none := func() error { return nil }
+
+	dir, disk, g := setup()
+	steps, total := 0, 0
+	err := mergeRange(dir, 1, 3, "", func(s, n int) { steps, total = s, n }, none)
+	if err != nil {
+		t.Fatalf("mergeRange: %s", err)
+	}
+	if total != 4 || steps != total {
+		t.Errorf("expected 4 of 4 steps, got %d of %d", steps, total)
+	}
+	check(dir, disk, []string{g[0], g[3]})
+	dd, _ := descriptor.Load(dir)
+	if len(dd.Images) != 2 || len(dd.Snapshots) != 2 {
+		t.Errorf("expected 2 images, got %+v", dd)
+	}
+	if f := dd.Image(g[3]).File; f != "d1" {
+		t.Errorf("expected file d1, got %s", f)
+	}
+	for _, f := range []string{"d2", "d3", "d1" + newSuffix} {
+		if _, err = os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s is left: %v", f, err)
+		}
+	}
+
+	// into the base delta, with a new file name
+	dir, disk, g = setup()
+	if err = mergeRange(dir, 0, 2, filepath.Join(dir, "merged"), nil, none); err != nil {
+		t.Fatalf("mergeRange: %s", err)
+	}
+	check(dir, disk, []string{g[2], g[3]})
+	for _, f := range []string{DefaultFile, "d1", "d2"} {
+		if _, err = os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s is left: %v", f, err)
+		}
+	}
+
+	// aborted, or with a branch depending on a merged delta
+	dir, disk, g = setup()
+	abort := func() error { return &Err{c: E_ABORT} }
+	if err = mergeRange(dir, 1, 3, "", nil, abort); !IsError(err, E_ABORT) {
+		t.Errorf("expected E_ABORT, got %v", err)
+	}
+	err = descriptor.Update(dir, func(dd *descriptor.Descriptor) error {
+		dd.Images = append(dd.Images, descriptor.Image{GUID: "{branch}", Type: descriptor.TypeExpanded, File: "d3"})
+		dd.Snapshots = append(dd.Snapshots, descriptor.Snapshot{GUID: "{branch}", ParentGUID: g[1]})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mergeRange(dir, 1, 3, "", nil, none); !IsError(err, E_PARAM) {
+		t.Errorf("expected E_PARAM, got %v", err)
+	}
+	if err = mergeRange(dir, 2, 2, "", nil, none); !IsError(err, E_PARAM) {
+		t.Errorf("expected E_PARAM, got %v", err)
+	}
+	g = append(g, "{branch}")
+	dd, _ = descriptor.Load(dir)
+	if len(dd.Images) != len(g) {
+		t.Errorf("expected %d images, got %d", len(g), len(dd.Images))
+	}
+	check(dir, disk, g[:4])
+}
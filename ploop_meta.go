@@ -0,0 +1,78 @@
+package ploop
+
+// Snapshot metadata (description, creation time and labels) is kept
+// in DiskDescriptor.xml by this package. libploop does not know about
+// it and drops it whenever it rewrites the descriptor, so it is saved
+// before every libploop call which might do that, and put back after,
+// holding the libploop descriptor lock while doing so.
+// This only works for calls made via this package: if the descriptor
+// is rewritten by another tool (the ploop utility, vzctl etc.), the
+// metadata is lost for good.
+
+import (
+	"errors"
+
+	"github.com/kolyshkin/goploop/descriptor"
+)
+
+// snapMeta is snapshot metadata, by snapshot uuid
+type snapMeta map[string]descriptor.Snapshot
+
+// loadMeta reads metadata of all snapshots from a descriptor file.
+// Errors are ignored, as libploop reports those on its own.
+func loadMeta(file string) snapMeta {
+	m := make(snapMeta)
+	dd, err := descriptor.Load(file)
+	if err != nil {
+		return m
+	}
+	for _, s := range dd.Snapshots {
+		if s.HasMeta() {
+			m[s.GUID] = s
+		}
+	}
+	return m
+}
+
+// errUnchanged is returned by a descriptor.Update callback
+// to skip saving a descriptor
+var errUnchanged = errors.New("descriptor is not changed")
+
+// restore writes metadata back to a descriptor file, for those
+// snapshots which still exist but lost it. This is done under the
+// libploop descriptor lock, so that changes made by others are kept.
+func (m snapMeta) restore(file string) error {
+	if len(m) == 0 {
+		return nil
+	}
+	err := descriptor.Update(file, func(dd *descriptor.Descriptor) error {
+		changed := false
+		for n := range dd.Snapshots {
+			s := &dd.Snapshots[n]
+			if o, ok := m[s.GUID]; ok && !s.HasMeta() {
+				s.Description, s.Created, s.Labels = o.Description, o.Created, o.Labels
+				changed = true
+			}
+		}
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil && err != errUnchanged {
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+
+	return nil
+}
+
+// fill sets metadata fields of snapshots in info
+func (m snapMeta) fill(info []SnapshotInfo) {
+	for n := range info {
+		if s, ok := m[info[n].UUID]; ok {
+			info[n].Description = s.Description
+			info[n].Created = s.Created
+			info[n].Labels = s.Labels
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package ploop
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kolyshkin/goploop/descriptor"
+)
+
+func TestSnapshotMeta(t *testing.T) {
+	file := filepath.Join(t.TempDir(), descriptor.FileName)
+	dd := descriptor.New(2048, 2048, DefaultFile)
+	uuid := dd.TopGUID
+	created := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	s := dd.Snapshot(uuid)
+	s.Description, s.Created = "base", created
+	if err := dd.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	m := loadMeta(file)
+	if len(m) != 1 || m[uuid].Description != "base" {
+		t.Fatalf("loadMeta: unexpected %+v", m)
+	}
+
+	// the descriptor is rewritten without metadata, as libploop does
+	s.Description, s.Created = "", time.Time{}
+	if err := dd.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.restore(file); err != nil {
+		t.Fatal(err)
+	}
+
+	info := []SnapshotInfo{{UUID: uuid}, {UUID: "{other}"}}
+	loadMeta(file).fill(info)
+	if info[0].Description != "base" || !info[0].Created.Equal(created) {
+		t.Errorf("fill: unexpected %+v", info[0])
+	}
+	if info[1].Description != "" {
+		t.Errorf("fill: unexpected %+v", info[1])
+	}
+}
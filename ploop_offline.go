@@ -0,0 +1,197 @@
+package ploop
+
+// Creation of ploop images in pure Go, without libploop or
+// the ploop kernel module (and so without root privileges)
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/kolyshkin/goploop/descriptor"
+	"github.com/kolyshkin/goploop/format"
+)
+
+// CreateOffline creates a new expanded ploop image and its
+// DiskDescriptor.xml (in the same directory), the same way Create does,
+// but without using libploop or the ploop kernel module.
+//
+// Unless p.NoFS is set, the inner file system is created by running
+// mkfs.<p.FSType> on a temporary file (next to the image) which is then
+// copied into the image, so mkfs for the requested type should be
+// available. Unless p.NoPartition is set, the file system is put into
+// a single partition of a GPT partition table. p.Flags is ignored,
+// and encryption is not supported.
+func CreateOffline(p *CreateParam) error {
+	if p.Mode != Expanded {
+		return &Err{c: E_PARAM, s: "only expanded images can be created offline"}
+	}
+	if p.KeyID != "" {
+		return &Err{c: E_PARAM, s: "encrypted images can not be created offline"}
+	}
+	if p.File == "" {
+		p.File = DefaultFile
+	}
+	clog := p.CLog
+	if clog == 0 {
+		clog = DefaultCLog
+	}
+	if clog < 6 || clog > 15 {
+		return &Err{c: E_PARAM, s: "cluster block size log should be from 6 to 15"}
+	}
+	blockSize := uint32(1) << clog
+	sectors := p.Size * 2
+	if sectors == 0 {
+		return &Err{c: E_PARAM, s: "image size is not set"}
+	}
+	if !p.NoFS && !p.NoPartition && sectors < gptMinSectors {
+		return &Err{c: E_PARAM, s: "image size is too small for a partition table"}
+	}
+	ddFile := filepath.Join(filepath.Dir(p.File), descriptor.FileName)
+	if _, err := os.Stat(ddFile); err == nil {
+		return &Err{c: E_CREAT, s: ddFile + " already exists"}
+	}
+
+	var err error
+	if p.NoFS {
+		err = writeImage(p.File, sectors, blockSize, []uint32{}, true, nil)
+	} else {
+		err = createOfflineFS(p, sectors, blockSize)
+	}
+	if err != nil {
+		return err
+	}
+
+	dd := descriptor.New(sectors, blockSize, filepath.Base(p.File))
+	if err = dd.Save(ddFile); err != nil {
+		os.Remove(p.File)
+		return &Err{c: E_DISKDESCR, s: err.Error()}
+	}
+
+	return nil
+}
+
+// offlineDisk is the contents of a new virtual disk: a file system
+// image put at a given offset, optionally surrounded by a partition table
+type offlineDisk struct {
+	head, tail []byte   // first and last sectors of the disk
+	fs         *os.File // file system image
+	fsOff      int64    // file system offset on the disk
+	fsSize     int64
+	size       int64 // disk size
+}
+
+// ReadAt reads the disk contents at a given offset (within the disk)
+func (d *offlineDisk) ReadAt(b []byte, off int64) (int, error) {
+	clear(b)
+	// copy the part of src (located at a given disk offset) overlapping b
+	put := func(src []byte, at int64) {
+		if at < off+int64(len(b)) && at+int64(len(src)) > off {
+			if at >= off {
+				copy(b[at-off:], src)
+			} else {
+				copy(b, src[off-at:])
+			}
+		}
+	}
+	put(d.head, 0)
+	put(d.tail, d.size-int64(len(d.tail)))
+
+	from, to := max(off, d.fsOff), min(off+int64(len(b)), d.fsOff+d.fsSize)
+	if from < to {
+		n, err := d.fs.ReadAt(b[from-off:to-off], from-d.fsOff)
+		if err != nil && !(err == io.EOF && from+int64(n) == to) {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// clusters returns the sorted list of disk clusters (of a given size)
+// which may contain data, or nil if it can not be figured out
+func (d *offlineDisk) clusters(clusterBytes int64) []uint32 {
+	// lseek(2) whence values for seeking to data and holes (Linux)
+	const seekData, seekHole = 3, 4
+
+	ret := []uint32{}
+	add := func(from, to int64) { // disk offsets, to is exclusive
+		for n := from / clusterBytes; n*clusterBytes < to; n++ {
+			if len(ret) == 0 || ret[len(ret)-1] < uint32(n) {
+				ret = append(ret, uint32(n))
+			}
+		}
+	}
+
+	add(0, int64(len(d.head)))
+	for off := int64(0); off < d.fsSize; {
+		data, err := d.fs.Seek(off, seekData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) { // no more data
+				break
+			}
+			return nil
+		}
+		hole, err := d.fs.Seek(data, seekHole)
+		if err != nil {
+			return nil
+		}
+		add(d.fsOff+data, d.fsOff+min(hole, d.fsSize))
+		off = hole
+	}
+	add(d.size-int64(len(d.tail)), d.size)
+
+	return ret
+}
+
+func createOfflineFS(p *CreateParam, sectors uint64, blockSize uint32) error {
+	fstype := p.FSType
+	if fstype == "" {
+		fstype = DefaultFSType
+	}
+	d := offlineDisk{size: int64(sectors) * format.SectorSize}
+	if p.NoPartition {
+		d.fsSize = d.size
+	} else {
+		head, tail, start, size := gpt(sectors)
+		d.head, d.tail = head, tail
+		d.fsOff = int64(start) * format.SectorSize
+		d.fsSize = int64(size) * format.SectorSize
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.File), ".create-*.fs")
+	if err != nil {
+		return &Err{c: E_CREAT, s: err.Error()}
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err = tmp.Truncate(d.fsSize); err != nil {
+		return &Err{c: E_WRITE, s: err.Error()}
+	}
+
+	args, err := mkfsArgs(p, fstype, tmp.Name())
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(fstype, "ext") {
+		// the target is not a block device
+		args = append([]string{"-F"}, args...)
+	}
+	if out, err := exec.Command("mkfs."+fstype, args...).CombinedOutput(); err != nil {
+		return &Err{c: E_MKFS, s: fmt.Sprintf("mkfs.%s: %s: %s", fstype, err, out)}
+	}
+	d.fs = tmp
+
+	cb := int64(blockSize) * format.SectorSize
+	return writeImage(p.File, sectors, blockSize, d.clusters(cb), true, func(c uint32, b []byte) error {
+		if _, err := d.ReadAt(b, int64(c)*cb); err != nil {
+			return &Err{c: E_READ, s: err.Error()}
+		}
+		return nil
+	})
+}
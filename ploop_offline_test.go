@@ -0,0 +1,77 @@
+package ploop
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/kolyshkin/goploop/descriptor"
+)
+
+func TestCreateOffline(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, DefaultFile)
+	p := CreateParam{Size: 64 * 1024, File: file, NoFS: true}
+	if err := CreateOffline(&p); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateOffline(&p); !IsError(err, E_CREAT) {
+		t.Errorf("expected E_CREAT, got %v", err)
+	}
+	dd, err := descriptor.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dd.TopGUID != descriptor.TopDeltaGUID {
+		t.Errorf("expected top delta GUID %s, got %s", descriptor.TopDeltaGUID, dd.TopGUID)
+	}
+
+	r, err := OpenChainReader(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 64<<20 {
+		t.Errorf("expected size %d, got %d", 64<<20, r.Size())
+	}
+	if c := r.c.allocated(); len(c) != 0 {
+		t.Errorf("expected no allocated clusters, got %v", c)
+	}
+	r.Close()
+	if fs, err := imageFSType(dir, ""); err != nil || fs != "" {
+		t.Errorf("expected no file system, got %q (%v)", fs, err)
+	}
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("no mkfs.ext4")
+	}
+	for _, nopart := range []bool{false, true} {
+		dir := t.TempDir()
+		p := CreateParam{Size: 64 * 1024, File: filepath.Join(dir, DefaultFile),
+			NoPartition: nopart, FSLabel: "test", MkfsOptions: []string{"-q"}}
+		if err := CreateOffline(&p); err != nil {
+			t.Fatal(err)
+		}
+		if fs, err := imageFSType(dir, ""); err != nil || fs != "ext4" {
+			t.Errorf("expected ext4, got %q (%v)", fs, err)
+		}
+
+		r, err := OpenChainReader(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		off, err := partitionOffset(r)
+		r.Close()
+		if exp := map[bool]int64{false: 1 << 20, true: 0}[nopart]; err != nil || off != exp {
+			t.Errorf("expected partition at %d, got %d (%v)", exp, off, err)
+		}
+
+		// no leftovers
+		if m, _ := filepath.Glob(filepath.Join(dir, ".create-*")); len(m) != 0 {
+			t.Errorf("temporary files left: %v", m)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "DiskDescriptor.xml")); err != nil {
+			t.Error(err)
+		}
+	}
+}
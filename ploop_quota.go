@@ -0,0 +1,311 @@
+package ploop
+
+// Disk quota management for the inner file system of a mounted ploop,
+// in pure Go, using quotactl(2)
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// QuotaType is a type of disk quota
+type QuotaType int
+
+// Possible QuotaType values, same as USRQUOTA etc. in the kernel
+const (
+	UserQuota    QuotaType = 0 // per user (uid) quota
+	GroupQuota   QuotaType = 1 // per group (gid) quota
+	ProjectQuota QuotaType = 2 // per project quota, see SetProject
+)
+
+// String converts a QuotaType value to string
+func (t QuotaType) String() string {
+	switch t {
+	case UserQuota:
+		return "user"
+	case GroupQuota:
+		return "group"
+	case ProjectQuota:
+		return "project"
+	}
+	return "<unknown>"
+}
+
+// QuotaLimits holds disk quota limits, zero means no limit
+type QuotaLimits struct {
+	BytesSoft  uint64 // disk space soft limit, in bytes
+	BytesHard  uint64 // disk space hard limit, in bytes
+	InodesSoft uint64 // number of inodes soft limit
+	InodesHard uint64 // number of inodes hard limit
+}
+
+// QuotaUsage holds disk quota limits and usage of a user, group or project
+type QuotaUsage struct {
+	ID uint32 // uid, gid or project ID
+	QuotaLimits
+	Bytes       uint64    // disk space used, in bytes
+	Inodes      uint64    // number of inodes used
+	BytesGrace  time.Time // time the soft limit on space is enforced, if exceeded
+	InodesGrace time.Time // time the soft limit on inodes is enforced, if exceeded
+}
+
+// Quota manages disk quotas of a mounted ploop file system.
+// For the file system to support quotas, it should either be created
+// with the quota feature (e.g. ext4 with "-O quota,project" mkfs option,
+// see CreateParam.MkfsOptions), or be mounted with quota (see MountParam)
+// and have quota files created by quotacheck(8).
+type Quota struct {
+	Device     string // block device the file system is on
+	MountPoint string // where the file system is mounted
+}
+
+// NewQuota returns a Quota for a ploop device, as returned by
+// FindByDevice or ListDevices, which should have its file system mounted
+func NewQuota(i DeviceInfo) (*Quota, error) {
+	if i.MountPoint == "" {
+		return nil, &Err{c: E_DEV_NOT_MOUNTED, s: "file system on " + i.Partition + " is not mounted"}
+	}
+	return &Quota{Device: i.Partition, MountPoint: i.MountPoint}, nil
+}
+
+// quotactl(2) commands and constants, see <linux/quota.h>
+const (
+	qQuotaOn      = 0x800002
+	qQuotaOff     = 0x800003
+	qGetQuota     = 0x800007
+	qSetQuota     = 0x800008
+	qGetNextQuota = 0x800009
+
+	qfmtVfsV0 = 2 // quota formats, see quotaFormat
+	qfmtVfsV1 = 4
+
+	qifBLimits = 1
+	qifILimits = 4
+	qifBTime   = 16
+	qifITime   = 32
+
+	qifBlockSize = 1024 // units of dqb_bhardlimit and dqb_bsoftlimit
+)
+
+// ifDqblk is struct if_nextdqblk, which is struct if_dqblk plus an ID
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	ID         uint32
+}
+
+// quotactl calls quotactl(2) on the device, returning syscall.Errno
+// as is, so that the caller could check it (see wrap)
+func (q *Quota) quotactl(cmd int, t QuotaType, id uint32, addr unsafe.Pointer) error {
+	if t < UserQuota || t > ProjectQuota {
+		return &Err{c: E_PARAM, s: "unknown quota type"}
+	}
+	dev, err := syscall.BytePtrFromString(q.Device)
+	if err != nil {
+		return &Err{c: E_PARAM, s: err.Error()}
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL,
+		uintptr(cmd<<8|int(t)), uintptr(unsafe.Pointer(dev)),
+		uintptr(id), uintptr(addr), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// wrap converts an error returned by quotactl to *Err
+func (q *Quota) wrap(err error) error {
+	if errno, ok := err.(syscall.Errno); ok {
+		return &Err{c: E_SYS, s: "quotactl " + q.Device + ": " + errno.Error()}
+	}
+	return err
+}
+
+// quotaMagic is a quota file header magic for each QuotaType,
+// see struct v2_disk_dqheader in the kernel
+var quotaMagic = [...]uint32{0xd9c01f11, 0xd9c01927, 0xd9c03f14}
+
+// quotaFormat returns the quota format (as passed to quotactl)
+// of a quota file of a given type, read from its header: vfsv0 (as
+// created by quotacheck by default, or libploop) or vfsv1
+func quotaFormat(file string, t QuotaType) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, &Err{c: E_OPEN, s: err.Error()}
+	}
+	defer f.Close()
+
+	var h struct {
+		Magic   uint32
+		Version uint32
+	}
+	if err = binary.Read(f, binary.LittleEndian, &h); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, &Err{c: E_PARAM, s: file + ": not a quota file"}
+		}
+		return 0, &Err{c: E_READ, s: err.Error()}
+	}
+	if t < UserQuota || t > ProjectQuota || h.Magic != quotaMagic[t] {
+		return 0, &Err{c: E_PARAM, s: file + ": not a " + t.String() + " quota file"}
+	}
+	switch h.Version {
+	case 0:
+		return qfmtVfsV0, nil
+	case 1:
+		return qfmtVfsV1, nil
+	}
+	return 0, &Err{c: E_PARAM, s: fmt.Sprintf("%s: unknown quota format version %d", file, h.Version)}
+}
+
+// On turns on (and enforces) quota of a given type. If there is
+// a quota file (e.g. aquota.user) in the file system root, it is used,
+// in the format it has, otherwise the file system is expected to have
+// the quota feature.
+func (q *Quota) On(t QuotaType) error {
+	file := filepath.Join(q.MountPoint, "aquota."+t.String())
+	format := qfmtVfsV1 // used by the quota feature
+	if _, err := os.Stat(file); err == nil {
+		if format, err = quotaFormat(file, t); err != nil {
+			return err
+		}
+	} else {
+		file = q.MountPoint
+	}
+	p, err := syscall.BytePtrFromString(file)
+	if err != nil {
+		return &Err{c: E_PARAM, s: err.Error()}
+	}
+	return q.wrap(q.quotactl(qQuotaOn, t, uint32(format), unsafe.Pointer(p)))
+}
+
+// Off turns off quota of a given type
+func (q *Quota) Off(t QuotaType) error {
+	return q.wrap(q.quotactl(qQuotaOff, t, 0, nil))
+}
+
+// Set sets quota limits for a given user, group or project ID
+func (q *Quota) Set(t QuotaType, id uint32, l QuotaLimits) error {
+	b := ifDqblk{
+		BHardLimit: (l.BytesHard + qifBlockSize - 1) / qifBlockSize,
+		BSoftLimit: (l.BytesSoft + qifBlockSize - 1) / qifBlockSize,
+		IHardLimit: l.InodesHard,
+		ISoftLimit: l.InodesSoft,
+		Valid:      qifBLimits | qifILimits,
+	}
+	return q.wrap(q.quotactl(qSetQuota, t, id, unsafe.Pointer(&b)))
+}
+
+// Get returns quota limits and usage for a given user, group or project ID
+func (q *Quota) Get(t QuotaType, id uint32) (QuotaUsage, error) {
+	var b ifDqblk
+	if err := q.quotactl(qGetQuota, t, id, unsafe.Pointer(&b)); err != nil {
+		return QuotaUsage{}, q.wrap(err)
+	}
+	b.ID = id
+	return b.usage(), nil
+}
+
+// Report returns quota limits and usage for all the IDs
+// having any quota limits or usage, sorted by ID
+func (q *Quota) Report(t QuotaType) ([]QuotaUsage, error) {
+	var ret []QuotaUsage
+	for id := uint32(0); ; id++ {
+		var b ifDqblk
+		err := q.quotactl(qGetNextQuota, t, id, unsafe.Pointer(&b))
+		if err == syscall.ENOENT {
+			break // no more IDs
+		}
+		if err != nil {
+			return nil, q.wrap(err)
+		}
+		ret = append(ret, b.usage())
+		if b.ID == ^uint32(0) {
+			break
+		}
+		id = b.ID
+	}
+	return ret, nil
+}
+
+func (b *ifDqblk) usage() QuotaUsage {
+	u := QuotaUsage{
+		ID: b.ID,
+		QuotaLimits: QuotaLimits{
+			BytesHard:  b.BHardLimit * qifBlockSize,
+			BytesSoft:  b.BSoftLimit * qifBlockSize,
+			InodesHard: b.IHardLimit,
+			InodesSoft: b.ISoftLimit,
+		},
+		Bytes:  b.CurSpace,
+		Inodes: b.CurInodes,
+	}
+	if b.Valid&qifBTime != 0 && b.BTime != 0 {
+		u.BytesGrace = time.Unix(int64(b.BTime), 0)
+	}
+	if b.Valid&qifITime != 0 && b.ITime != 0 {
+		u.InodesGrace = time.Unix(int64(b.ITime), 0)
+	}
+	return u
+}
+
+// fsxattr is struct fsxattr, see <linux/fs.h>
+type fsxattr struct {
+	XFlags     uint32
+	ExtSize    uint32
+	NExtents   uint32
+	ProjID     uint32
+	CowExtSize uint32
+	Pad        [8]byte
+}
+
+// ioctls and flags to get and set project ID, see <linux/fs.h>
+const (
+	fsIocFSGetXattr    = 0x801c581f
+	fsIocFSSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x200
+)
+
+// SetProject assigns a project ID to a file or directory inside a mounted
+// ploop file system (with project quota support), for ProjectQuota limits
+// to apply to it. Files created inside a directory inherit its project ID.
+func SetProject(path string, id uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return &Err{c: E_OPEN, s: err.Error()}
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return &Err{c: E_FSTAT, s: err.Error()}
+	}
+
+	var x fsxattr
+	ioctl := func(req uintptr) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(&x)))
+		if errno != 0 {
+			return &Err{c: E_SYS, s: "set project of " + path + ": " + errno.Error()}
+		}
+		return nil
+	}
+	if err = ioctl(fsIocFSGetXattr); err != nil {
+		return err
+	}
+	x.ProjID = id
+	if fi.IsDir() {
+		x.XFlags |= fsXflagProjInherit
+	}
+	return ioctl(fsIocFSSetXattr)
+}
@@ -0,0 +1,91 @@
+package ploop
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestQuotaStructs(t *testing.T) {
+	// sizes of struct if_nextdqblk and struct fsxattr
+	if s := unsafe.Sizeof(ifDqblk{}); s != 72 {
+		t.Errorf("bad ifDqblk size %d", s)
+	}
+	if s := unsafe.Sizeof(fsxattr{}); s != 28 {
+		t.Errorf("bad fsxattr size %d", s)
+	}
+
+	b := ifDqblk{
+		BHardLimit: 2048, BSoftLimit: 1024, CurSpace: 4096,
+		IHardLimit: 10, CurInodes: 3, BTime: 1000,
+		Valid: qifBLimits | qifILimits | qifBTime, ID: 42,
+	}
+	exp := QuotaUsage{
+		ID:          42,
+		QuotaLimits: QuotaLimits{BytesHard: 2 << 20, BytesSoft: 1 << 20, InodesHard: 10},
+		Bytes:       4096,
+		Inodes:      3,
+		BytesGrace:  time.Unix(1000, 0),
+	}
+	if u := b.usage(); u != exp {
+		t.Errorf("expected %+v, got %+v", exp, u)
+	}
+}
+
+func TestNewQuota(t *testing.T) {
+	if _, err := NewQuota(DeviceInfo{Partition: "/dev/ploop1p1"}); !IsNotMounted(err) {
+		t.Errorf("expected not mounted error, got %v", err)
+	}
+	q, err := NewQuota(DeviceInfo{Partition: "/dev/ploop1p1", MountPoint: "/mnt"})
+	if err != nil || q.Device != "/dev/ploop1p1" || q.MountPoint != "/mnt" {
+		t.Errorf("unexpected %+v (%v)", q, err)
+	}
+	if err = q.Off(QuotaType(7)); !IsError(err, E_PARAM) {
+		t.Errorf("expected E_PARAM for a bad quota type, got %v", err)
+	}
+}
+
+func TestQuotaFormat(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	header := func(magic, version uint32) []byte {
+		return binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, magic), version)
+	}
+
+	for _, tc := range []struct {
+		t       QuotaType
+		version uint32
+		format  int
+	}{
+		{UserQuota, 0, qfmtVfsV0},
+		{GroupQuota, 1, qfmtVfsV1},
+		{ProjectQuota, 0, qfmtVfsV0},
+	} {
+		file := write("aquota."+tc.t.String(), header(quotaMagic[tc.t], tc.version))
+		if f, err := quotaFormat(file, tc.t); err != nil || f != tc.format {
+			t.Errorf("%s: expected format %d, got %d (%v)", file, tc.format, f, err)
+		}
+	}
+
+	for name, b := range map[string][]byte{
+		"short":   {1, 2, 3},
+		"magic":   header(quotaMagic[GroupQuota], 0),
+		"version": header(quotaMagic[UserQuota], 2),
+	} {
+		if _, err := quotaFormat(write(name, b), UserQuota); !IsError(err, E_PARAM) {
+			t.Errorf("%s: expected E_PARAM, got %v", name, err)
+		}
+	}
+	if _, err := quotaFormat(filepath.Join(dir, "none"), UserQuota); !IsError(err, E_OPEN) {
+		t.Errorf("expected E_OPEN, got %v", err)
+	}
+}
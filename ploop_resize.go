@@ -0,0 +1,160 @@
+package ploop
+
+import (
+	"context"
+	"fmt"
+)
+
+// #include <ploop/libploop.h>
+import "C"
+
+// Balloon maintenance states of a ploop device in which a relocation
+// is in progress, see PLOOP_MNTN_* in ploop_if.h
+const (
+	mntnFBLoaded = 2
+	mntnReloc    = 4
+)
+
+// ResizeEx changes the ploop size, with more control than Resize gives.
+// Unless p.Offline is set, shrinking is done by libploop by inflating
+// a balloon file in the file system (mounting the ploop if needed),
+// the size of which can be limited by p.MaxBalloon. With p.NoBalloon,
+// the file system is shrunk offline instead, so the ploop should not
+// be mounted. If a balloon relocation of a mounted ploop was interrupted
+// earlier, it is completed first. Growing can be split into separate
+// steps: with p.DeviceOnly, the image and the block device are grown
+// but the file system is not, and with p.FSOnly, the file system (and
+// its partition) of a mounted ploop is grown to fill the block device.
+// Sizes before and after the resize are returned.
+func (d Ploop) ResizeEx(p *ResizeParam) (ResizeResult, error) {
+	return d.ResizeExContext(context.Background(), p)
+}
+
+// ResizeExContext is the same as ResizeEx, but can be cancelled via ctx.
+// See runContext for details.
+func (d Ploop) ResizeExContext(ctx context.Context, p *ResizeParam) (ResizeResult, error) {
+	var r ResizeResult
+
+	switch {
+	case p.DeviceOnly && p.FSOnly:
+		return r, &Err{c: E_PARAM, s: "DeviceOnly and FSOnly are mutually exclusive"}
+	case p.FSOnly && (p.Size != 0 || p.Offline):
+		return r, &Err{c: E_PARAM, s: "FSOnly grows a mounted file system to fill the device, size can't be set"}
+	case p.NoBalloon && p.MaxBalloon != 0:
+		return r, &Err{c: E_PARAM, s: "NoBalloon and MaxBalloon are mutually exclusive"}
+	case p.Size == 0 && !p.FSOnly:
+		return r, &Err{c: E_PARAM, s: "size is not set"}
+	}
+
+	var err error
+	r.OldSize, r.OldFSSize, err = d.sizes()
+	if err != nil {
+		return r, err
+	}
+	shrink := p.Size < r.OldSize
+
+	switch {
+	case p.DeviceOnly:
+		if shrink {
+			return r, &Err{c: E_PARAM, s: "DeviceOnly can only grow the image"}
+		}
+		sectors := C.off_t(convertSize(p.Size))
+		err = d.runContext(ctx, func(d Ploop) error {
+			return d.callMeta(func(di *cDisk) C.int {
+				return C.ploop_grow_image(di, sectors, 0)
+			})
+		})
+	case p.FSOnly:
+		err = d.runContext(ctx, func(d Ploop) error {
+			i, err := d.Device()
+			if err != nil {
+				return err
+			}
+			return growFS(i)
+		})
+	default:
+		var mounted bool
+		if mounted, err = d.IsMounted(); err != nil {
+			return r, err
+		}
+		balloon := shrink && !p.Offline && !p.NoBalloon
+		switch {
+		case shrink && p.NoBalloon && mounted:
+			return r, &Err{c: E_PARAM, s: "can't shrink a mounted ploop without a balloon"}
+		case balloon && p.MaxBalloon != 0 && r.OldSize-p.Size > p.MaxBalloon:
+			return r, &Err{c: E_PARAM, s: fmt.Sprintf("shrinking by %d KB needs a balloon larger than %d KB",
+				r.OldSize-p.Size, p.MaxBalloon)}
+		}
+		if mounted {
+			if r.Relocated, err = d.completeRelocation(); err != nil {
+				return r, err
+			}
+		}
+
+		var a C.struct_ploop_resize_param
+		a.size = convertSize(p.Size)
+		a.offline_resize = boolToC(p.Offline || (shrink && p.NoBalloon))
+		err = d.runContext(ctx, func(d Ploop) error {
+			return d.callMeta(func(di *cDisk) C.int {
+				return C.ploop_resize_image(di, &a)
+			})
+		})
+	}
+	if err != nil {
+		return r, err
+	}
+
+	r.NewSize, r.NewFSSize, err = d.sizes()
+
+	return r, err
+}
+
+// sizes returns the image size and, if it is mounted,
+// the inner file system size (both in kilobytes)
+func (d Ploop) sizes() (uint64, uint64, error) {
+	i, err := d.ImageInfo()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := i.Blocks / 2
+
+	m, err := d.IsMounted()
+	if err != nil || !m {
+		return size, 0, err
+	}
+	fs, err := FSInfo(d.h.file)
+	if err != nil {
+		// not fatal, the file system might be not mounted
+		return size, 0, nil
+	}
+
+	return size, fs.Blocks * fs.BlockSize / 1024, nil
+}
+
+// completeRelocation completes a balloon relocation of a mounted ploop
+// which was interrupted (e.g. by a crash during a shrink), as it has to
+// be done before the ploop can be resized. It returns true if there was
+// such a relocation.
+func (d Ploop) completeRelocation() (bool, error) {
+	i, err := d.Device()
+	if err != nil {
+		return false, err
+	}
+	dev := C.CString(i.Device)
+	defer cfree(dev)
+
+	var state C.__u32
+	err = call(func() C.int {
+		return C.ploop_balloon_get_state(dev, &state)
+	})
+	if err != nil {
+		return false, err
+	}
+	if state != mntnFBLoaded && state != mntnReloc {
+		return false, nil
+	}
+
+	return true, call(func() C.int {
+		return C.ploop_balloon_complete(dev)
+	})
+}
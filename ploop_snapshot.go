@@ -0,0 +1,218 @@
+package ploop
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// #include <ploop/libploop.h>
+import "C"
+
+// Snapshots returns a list of ploop snapshots, in the order
+// they are listed in DiskDescriptor.xml
+func (d Ploop) Snapshots() ([]SnapshotInfo, error) {
+	var info []SnapshotInfo
+
+	err := d.do(func(di *cDisk) error {
+		ret := C.ploop_read_dd(di)
+		if ret != 0 {
+			return mkerr(ret)
+		}
+		info = snapshots(di)
+		loadMeta(d.h.file).fill(info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Backup writes the data of clusters which differ between snapshots
+// from and to (i.e. were changed after from was taken and before to
+// was taken) to w, in a backup stream format (see ploop_backup.go).
+// If from is empty, a full backup of snapshot to is made.
+//
+// Deltas are read directly, so to should be a snapshot rather
+// than the top delta of a mounted ploop, and the image should not be
+// encrypted. Use Restore to apply the backup stream.
+func (d Ploop) Backup(from, to string, w io.Writer) (BackupStat, error) {
+	id, err := d.KeyID()
+	if err != nil {
+		return BackupStat{}, err
+	}
+	if id != "" {
+		return BackupStat{}, &Err{c: E_PARAM, s: "image is encrypted"}
+	}
+	s, err := d.Snapshots()
+	if err != nil {
+		return BackupStat{}, err
+	}
+	info, err := d.ImageInfo()
+	if err != nil {
+		return BackupStat{}, err
+	}
+	mode, err := d.Mode()
+	if err != nil {
+		return BackupStat{}, err
+	}
+
+	return writeBackup(s, info.Blocks*512, int64(info.BlockSize)*512, mode == Raw, from, to, w)
+}
+
+// snapshots converts libploop snapshots data to a SnapshotInfo list
+func snapshots(di *cDisk) []SnapshotInfo {
+	images := unsafe.Slice(di.images, di.nimages)
+	snaps := unsafe.Slice(di.snapshots, di.nsnapshots)
+	top := C.GoString(di.top_guid)
+
+	files := make(map[string]string, len(images))
+	for _, i := range images {
+		files[C.GoString(i.guid)] = C.GoString(i.file)
+	}
+
+	info := make([]SnapshotInfo, 0, len(snaps))
+	for _, s := range snaps {
+		uuid := C.GoString(s.guid)
+		info = append(info, SnapshotInfo{
+			UUID:       uuid,
+			ParentUUID: C.GoString(s.parent_guid),
+			File:       files[uuid],
+			ReadOnly:   uuid != top,
+			Temporary:  s.temporary != 0,
+			Current:    uuid == top,
+		})
+	}
+
+	return info
+}
+
+// SnapshotMount is a snapshot mounted by MountSnapshot
+type SnapshotMount struct {
+	UUID       string // snapshot uuid (of a temporary snapshot, if Temporary)
+	Temporary  bool   // a temporary snapshot was created to be mounted
+	Device     string // ploop device the snapshot is attached to
+	MountPoint string // where the snapshot file system is mounted
+
+	d         Ploop
+	holder    int // fd returned by ploop_create_temporary_snapshot, or -1
+	mu        sync.Mutex
+	unmounted bool // Close has unmounted the snapshot
+	removed   bool // Close has removed the temporary snapshot
+}
+
+// MountSnapshot mounts a snapshot with a given uuid read-only to target,
+// on a separate ploop device, so it can be done while the ploop itself
+// is mounted and in use. If uuid is empty, or is the uuid of the top
+// delta of a mounted ploop, a temporary snapshot is created and mounted,
+// providing a consistent point-in-time view of the current data.
+// The file system type is detected from the snapshot (see FSTypeAuto).
+//
+// The returned handle's Close() unmounts the snapshot, and removes
+// the temporary snapshot (merging it back), if any.
+func (d Ploop) MountSnapshot(uuid, target string) (*SnapshotMount, error) {
+	s, err := d.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	var found, top bool
+	for _, i := range s {
+		if i.UUID == uuid || (uuid == "" && i.Current) {
+			found, top = true, i.Current
+			uuid = i.UUID
+			break
+		}
+	}
+	if !found {
+		return nil, &Err{c: E_NOSNAP, s: "no such snapshot " + uuid}
+	}
+
+	m := &SnapshotMount{UUID: uuid, d: d, holder: -1}
+	if top {
+		mounted, err := d.IsMounted()
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			if err = m.createTemporary(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	p := MountParam{
+		UUID:      m.UUID,
+		Target:    target,
+		Readonly:  true,
+		FSType:    FSTypeAuto,
+		Component: "snap-" + strings.Trim(m.UUID, "{}")[:8],
+	}
+	r, err := d.MountExtended(&p)
+	if err != nil {
+		m.cleanup()
+		return nil, err
+	}
+	m.Device, m.MountPoint = r.Device, r.MountPoint
+
+	return m, nil
+}
+
+// createTemporary creates a temporary snapshot of the top delta
+func (m *SnapshotMount) createTemporary() error {
+	var a C.struct_ploop_tsnapshot_param
+	var holder C.int = -1
+
+	uuid, err := UUID()
+	if err != nil {
+		return err
+	}
+	a.guid = C.CString(uuid)
+	defer cfree(a.guid)
+
+	err = m.d.callMeta(func(di *cDisk) C.int {
+		return C.ploop_create_temporary_snapshot(di, &a, &holder)
+	})
+	if err != nil {
+		return err
+	}
+	m.UUID, m.Temporary, m.holder = uuid, true, int(holder)
+
+	return nil
+}
+
+// cleanup removes the temporary snapshot, if any (and not yet removed)
+func (m *SnapshotMount) cleanup() error {
+	if m.holder >= 0 {
+		syscall.Close(m.holder)
+		m.holder = -1
+	}
+	if !m.Temporary || m.removed {
+		return nil
+	}
+	if err := m.d.DeleteSnapshot(m.UUID); err != nil {
+		return err
+	}
+	m.removed = true
+
+	return nil
+}
+
+// Close unmounts the snapshot and removes the temporary state.
+// It is safe to call Close more than once. If it fails, it can be
+// retried, and the steps already done are not repeated.
+func (m *SnapshotMount) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.unmounted {
+		if err := UmountByDevice(m.Device); err != nil && !IsNotMounted(err) {
+			return err
+		}
+		m.unmounted = true
+	}
+	return m.cleanup()
+}
@@ -1,13 +1,18 @@
+//go:build cgo
+
 package ploop
 
 // A test suite, also serving as an example of how to use the package
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sync"
 	"testing"
 
 	"github.com/dustin/go-humanize"
@@ -110,13 +115,60 @@ func TestMount(t *testing.T) {
 	e := os.Mkdir(mnt, 0755)
 	chk(e)
 
-	p := MountParam{Target: mnt}
-	dev, e := d.Mount(&p)
+	p := MountParam{Target: mnt, Fsck: true}
+	r, e := d.MountExtended(&p)
 	if e != nil {
 		abort("Mount: %s", e)
 	}
 
-	t.Logf("Mounted; ploop device %s", dev)
+	t.Logf("Mounted; ploop device %s, partition %s, mount point %s, fsck: %s, deltas %v",
+		r.Device, r.Partition, r.MountPoint, r.Fsck, r.Deltas)
+	if len(r.Deltas) != 1 {
+		t.Errorf("Mount: expected 1 delta, got %v", r.Deltas)
+	}
+}
+
+func TestDevice(t *testing.T) {
+	i, e := d.Device()
+	if e != nil {
+		t.Fatalf("Device: %s", e)
+	}
+	t.Logf("Device %s, mount point %s, descriptor %s", i.Device, i.MountPoint, i.Descriptor)
+	for _, dl := range i.Deltas {
+		t.Logf("  delta %s (%s, io %s, ro %v)", dl.File, dl.Format, dl.IO, dl.ReadOnly)
+	}
+
+	f, e := FindByDevice(i.Device)
+	if e != nil || f.Top().File != i.Top().File {
+		t.Errorf("FindByDevice(%s): %+v, %v", i.Device, f, e)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	q, e := d.Quota()
+	if e != nil {
+		t.Fatalf("Quota: %s", e)
+	}
+	if e = q.On(UserQuota); e != nil {
+		t.Skipf("Quota: can't turn user quota on: %s", e)
+	}
+	defer q.Off(UserQuota)
+
+	l := QuotaLimits{BytesSoft: 1 << 20, BytesHard: 2 << 20, InodesHard: 100}
+	if e = q.Set(UserQuota, 1000, l); e != nil {
+		t.Fatalf("Quota.Set: %s", e)
+	}
+	u, e := q.Get(UserQuota, 1000)
+	if e != nil || u.QuotaLimits != l {
+		t.Errorf("Quota.Get: expected %+v, got %+v (%v)", l, u.QuotaLimits, e)
+	}
+	r, e := q.Report(UserQuota)
+	if e != nil {
+		t.Fatalf("Quota.Report: %s", e)
+	}
+	for _, u := range r {
+		t.Logf("uid %d: %s used, %d inodes", u.ID, humanize.Bytes(u.Bytes), u.Inodes)
+	}
 }
 
 func resize(t *testing.T, size string, offline bool) {
@@ -143,6 +195,97 @@ func TestResizeOnlineGrow(t *testing.T) {
 	resize(t, "512MB", false)
 }
 
+func TestResizeEx(t *testing.T) {
+	size := uint64(640 << 10) // 640M, in kilobytes
+	r, e := d.ResizeEx(&ResizeParam{Size: size, DeviceOnly: true})
+	if e != nil {
+		t.Fatalf("ResizeEx (device only): %s", e)
+	}
+	if r.NewSize != size || r.NewFSSize != r.OldFSSize {
+		t.Errorf("ResizeEx (device only): unexpected result %+v", r)
+	}
+
+	r, e = d.ResizeEx(&ResizeParam{FSOnly: true})
+	if e != nil {
+		t.Fatalf("ResizeEx (fs only): %s", e)
+	}
+	if r.NewSize != size || r.NewFSSize <= r.OldFSSize {
+		t.Errorf("ResizeEx (fs only): unexpected result %+v", r)
+	}
+
+	if _, e = d.ResizeEx(&ResizeParam{Size: size, DeviceOnly: true, FSOnly: true}); !IsError(e, E_PARAM) {
+		t.Errorf("ResizeEx: expected E_PARAM, got %v", e)
+	}
+
+	// the ploop is mounted, so it can only be shrunk with a balloon
+	small := size - 64<<10
+	if _, e = d.ResizeEx(&ResizeParam{Size: small, NoBalloon: true}); !IsError(e, E_PARAM) {
+		t.Errorf("ResizeEx (no balloon): expected E_PARAM, got %v", e)
+	}
+	if _, e = d.ResizeEx(&ResizeParam{Size: small, MaxBalloon: 32 << 10}); !IsError(e, E_PARAM) {
+		t.Errorf("ResizeEx (small balloon): expected E_PARAM, got %v", e)
+	}
+	r, e = d.ResizeEx(&ResizeParam{Size: small, MaxBalloon: 64 << 10})
+	if e != nil {
+		t.Fatalf("ResizeEx (shrink): %s", e)
+	}
+	if r.NewSize != small || r.Relocated {
+		t.Errorf("ResizeEx (shrink): unexpected result %+v", r)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	r, e := d.Compact(&CompactParam{DryRun: true})
+	if e != nil {
+		t.Fatalf("Compact (dry run): %s", e)
+	}
+	if !r.Skipped {
+		t.Errorf("Compact (dry run): not skipped")
+	}
+	t.Logf("Reclaimable: %s", humanize.Bytes(r.Before.Reclaimable()))
+
+	r, e = d.Compact(&CompactParam{})
+	if e != nil {
+		t.Fatalf("Compact: %s", e)
+	}
+	t.Logf("Reclaimed: %s", humanize.Bytes(r.Reclaimed))
+}
+
+func TestCopy(t *testing.T) {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := CopyReceive(r, "copy.hdd")
+		r.CloseWithError(err)
+		done <- err
+	}()
+
+	frozen := false
+	p := CopyParam{MaxRounds: 3, Freeze: func() error {
+		frozen = true
+		return nil
+	}}
+	stats, e := CopySend(d, w, &p)
+	w.CloseWithError(e)
+	if e != nil {
+		t.Fatalf("CopySend: %s", e)
+	}
+	if e = <-done; e != nil {
+		t.Fatalf("CopyReceive: %s", e)
+	}
+	if !frozen || len(stats) < 2 || !stats[len(stats)-1].Final {
+		t.Errorf("CopySend: unexpected stats %+v (frozen %v)", stats, frozen)
+	}
+	for _, s := range stats {
+		t.Logf("Round %d: sent %s", s.Round, humanize.Bytes(s.Xferred))
+	}
+
+	if r, e := Check("copy.hdd", CheckParam{ReadOnly: true}); e != nil || !r.Clean() {
+		t.Errorf("Check copy: %v %v", r.Problems, e)
+	}
+	os.Remove("copy.hdd")
+}
+
 func TestSnapshot(t *testing.T) {
 	uuid, e := d.Snapshot()
 	if e != nil {
@@ -153,6 +296,68 @@ func TestSnapshot(t *testing.T) {
 	snap = uuid
 }
 
+func TestSnapshotBackup(t *testing.T) {
+	var b bytes.Buffer
+	st, e := d.Backup("", snap, &b)
+	if e != nil {
+		t.Fatalf("Backup: %s", e)
+	}
+	t.Logf("Backup: %d clusters, %s", st.Clusters, humanize.Bytes(st.Bytes))
+
+	h, e := Restore(&b, &discardAt{})
+	if e != nil {
+		t.Fatalf("Restore: %s", e)
+	}
+	if h.To != snap {
+		t.Errorf("Restore: expected snapshot %s, got %s", snap, h.To)
+	}
+}
+
+// discardAt is an io.WriterAt which discards everything
+type discardAt struct{}
+
+func (discardAt) WriteAt(b []byte, _ int64) (int, error) {
+	return len(b), nil
+}
+
+func TestMountSnapshot(t *testing.T) {
+	mnt := "snapmnt"
+	chk(os.Mkdir(mnt, 0755))
+	defer os.Remove(mnt)
+
+	before, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+
+	// an existing snapshot, and a temporary one of the current data
+	for _, uuid := range []string{snap, ""} {
+		m, e := d.MountSnapshot(uuid, mnt)
+		if e != nil {
+			t.Fatalf("MountSnapshot(%q): %s", uuid, e)
+		}
+		t.Logf("Mounted snapshot %s (temporary: %v) on %s at %s",
+			m.UUID, m.Temporary, m.Device, m.MountPoint)
+		if m.Temporary != (uuid == "") {
+			t.Errorf("MountSnapshot(%q): unexpected Temporary %v", uuid, m.Temporary)
+		}
+		if e = m.Close(); e != nil {
+			t.Errorf("Close: %s", e)
+		}
+		if e = m.Close(); e != nil {
+			t.Errorf("Close (again): %s", e)
+		}
+	}
+
+	after, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+	if len(after) != len(before) {
+		t.Errorf("MountSnapshot: snapshots left behind: %v", after)
+	}
+}
+
 func TestTopDeltaFile(t *testing.T) {
 	f, e := d.TopDeltaFile()
 	if e != nil {
@@ -161,6 +366,30 @@ func TestTopDeltaFile(t *testing.T) {
 	t.Logf("Got TopDeltaFile %s", f)
 }
 
+func TestSnapshots(t *testing.T) {
+	s, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+	if len(s) != 2 {
+		t.Fatalf("Snapshots: expected 2 snapshots, got %d", len(s))
+	}
+
+	found := false
+	for _, i := range s {
+		if i.UUID == snap {
+			found = true
+			if i.Current || !i.ReadOnly {
+				t.Errorf("Snapshots: snapshot %s is top delta", snap)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Snapshots: snapshot %s not found", snap)
+	}
+	t.Logf("Snapshot tree:\n%s", SnapshotTree(s))
+}
+
 func copyFile(src, dst string) error {
 	return exec.Command("cp", "-a", src, dst).Run()
 }
@@ -215,6 +444,24 @@ func TestIsMounted1(t *testing.T) {
 	}
 }
 
+func TestConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, e := d.IsMounted(); e != nil {
+				t.Errorf("IsMounted: %s", e)
+			}
+			if _, e := d.ImageInfo(); e != nil {
+				t.Errorf("ImageInfo: %s", e)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func TestUmount(t *testing.T) {
 	e := d.Umount()
 	if e != nil {
@@ -241,6 +488,18 @@ func TestUmountAgain(t *testing.T) {
 	}
 }
 
+func TestCheck(t *testing.T) {
+	r, e := d.Check(CheckParam{ReadOnly: true})
+	if e != nil {
+		t.Fatalf("Check: %s", e)
+	}
+	for _, i := range r {
+		if !i.Clean() {
+			t.Errorf("Check: %s: problems found: %v", i.File, i.Problems)
+		}
+	}
+}
+
 func TestResizeOfflineShrink(t *testing.T) {
 	resize(t, "256MB", true)
 }
@@ -320,13 +579,223 @@ func TestImageInfo(t *testing.T) {
 
 }
 
-func cleanup() {
-	if d.d != nil {
-		if m, _ := d.IsMounted(); m {
-			d.Umount()
+func TestSnapshotExtended(t *testing.T) {
+	p := SnapshotParam{Description: "before upgrade", Labels: map[string]string{"app": "db"}}
+	uuid, e := d.SnapshotExtended(&p)
+	if e != nil {
+		t.Fatalf("SnapshotExtended: %s", e)
+	}
+	bare, e := d.SnapshotExtended(&SnapshotParam{})
+	if e != nil {
+		t.Fatalf("SnapshotExtended: %s", e)
+	}
+	// make libploop rewrite DiskDescriptor.xml
+	plain, e := d.Snapshot()
+	if e != nil {
+		t.Fatalf("Snapshot: %s", e)
+	}
+
+	s, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+	found := false
+	for _, i := range s {
+		switch i.UUID {
+		case uuid:
+			found = true
+			if i.Description != p.Description || i.Labels["app"] != "db" || i.Created.IsZero() {
+				t.Errorf("Snapshots: unexpected metadata %+v", i)
+			}
+		case bare:
+			if i.Description != "" || i.Labels != nil || i.Created.IsZero() {
+				t.Errorf("Snapshots: expected creation time only, got %+v", i)
+			}
+		case plain:
+			if i.Description != "" || i.Labels != nil || !i.Created.IsZero() {
+				t.Errorf("Snapshots: unexpected metadata for a plain snapshot %+v", i)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Snapshots: snapshot %s not found", uuid)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		if _, e := d.Snapshot(); e != nil {
+			t.Fatalf("Snapshot: %s", e)
+		}
+	}
+	s, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+	chain := chainUUIDs(s)
+	top := len(chain) - 1
+	var before bytes.Buffer
+	if e = Export(d.h.file, "", &before, StreamRaw); e != nil {
+		t.Fatalf("Export: %s", e)
+	}
+
+	steps, total := -1, -1
+	p := MergeParam{FromLevel: 1, ToLevel: top,
+		Progress: func(step, n int) { steps, total = step, n }}
+	if e = d.Merge(&p); e != nil {
+		t.Fatalf("Merge (range): %s", e)
+	}
+	if steps != total {
+		t.Errorf("Merge (range): expected %d steps, got %d", total, steps)
+	}
+	s, e = d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+	if c := chainUUIDs(s); len(c) != 2 || c[0] != chain[0] || c[1] != chain[top] {
+		t.Errorf("Merge (range): expected chain %v, got %v", []string{chain[0], chain[top]}, c)
+	}
+	var after bytes.Buffer
+	if e = Export(d.h.file, "", &after, StreamRaw); e != nil {
+		t.Fatalf("Export: %s", e)
+	}
+	if !bytes.Equal(before.Bytes(), after.Bytes()) {
+		t.Errorf("Merge (range): data differs")
+	}
+
+	if e = d.Merge(&MergeParam{All: true}); e != nil {
+		t.Fatalf("Merge (all): %s", e)
+	}
+	if s, _ = d.Snapshots(); len(chainUUIDs(s)) != 1 {
+		t.Errorf("Merge (all): expected 1 delta, got %d", len(chainUUIDs(s)))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	var before bytes.Buffer
+	if e := Export(d.h.file, "", &before, StreamRaw); e != nil {
+		t.Fatalf("Export: %s", e)
+	}
+	s, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+
+	for _, m := range []ImageMode{Preallocated, Expanded, Raw, Preallocated, Raw, Expanded} {
+		if e := d.Convert(m); e != nil {
+			t.Fatalf("Convert to %s: %s", m, e)
+		}
+		if cur, e := d.Mode(); e != nil || cur != m {
+			t.Errorf("Mode: expected %s, got %s (%v)", m, cur, e)
+		}
+		var after bytes.Buffer
+		if e := Export(d.h.file, "", &after, StreamRaw); e != nil {
+			t.Fatalf("Export: %s", e)
+		}
+		if !bytes.Equal(before.Bytes(), after.Bytes()) {
+			t.Errorf("Convert to %s: data differs", m)
+		}
+		if ns, e := d.Snapshots(); e != nil || len(ns) != len(s) {
+			t.Errorf("Convert to %s: expected %d snapshots, got %d (%v)", m, len(s), len(ns), e)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	// keys are passed to libploop's crypt helper via KeyDirEnv
+	keys := FileKeys(t.TempDir())
+	chk(keys.Put("key-1", []byte("0123456789abcdef0123456789abcdef")))
+	chk(keys.Put("key-2", []byte("fedcba9876543210fedcba9876543210")))
+
+	// snapshots can't be decrypted, so get rid of them
+	s, e := d.Snapshots()
+	if e != nil {
+		t.Fatalf("Snapshots: %s", e)
+	}
+	for _, i := range s {
+		if !i.Current {
+			chk(d.DeleteSnapshot(i.UUID))
 		}
-		d.Close()
 	}
+	var before bytes.Buffer
+	if e = Export(d.h.file, "", &before, StreamRaw); e != nil {
+		t.Fatalf("Export: %s", e)
+	}
+
+	if e := d.Encrypt(&EncryptParam{KeyID: "key-1", Keys: keys}); e != nil {
+		t.Fatalf("Encrypt: %s", e)
+	}
+	if e := d.Encrypt(&EncryptParam{KeyID: "key-1", Keys: keys}); !IsError(e, E_PARAM) {
+		t.Errorf("Encrypt (again): expected E_PARAM, got %v", e)
+	}
+	if e := d.RotateKey(&EncryptParam{KeyID: "key-2", Keys: keys}); e != nil {
+		t.Fatalf("RotateKey: %s", e)
+	}
+	if id, e := d.KeyID(); e != nil || id != "key-2" {
+		t.Errorf("KeyID: expected key-2, got %q (%v)", id, e)
+	}
+	if e := Export(d.h.file, "", io.Discard, StreamRaw); !IsError(e, E_PARAM) {
+		t.Errorf("Export: expected E_PARAM for an encrypted image, got %v", e)
+	}
+
+	if _, e := d.Mount(&MountParam{Keys: keys}); e != nil {
+		t.Fatalf("Mount: %s", e)
+	}
+	if e := d.Umount(); e != nil {
+		t.Fatalf("Umount: %s", e)
+	}
+
+	if e := d.Decrypt(keys); e != nil {
+		t.Fatalf("Decrypt: %s", e)
+	}
+	if id, e := d.KeyID(); e != nil || id != "" {
+		t.Errorf("KeyID: expected no key, got %q (%v)", id, e)
+	}
+	var after bytes.Buffer
+	if e = Export(d.h.file, "", &after, StreamRaw); e != nil {
+		t.Fatalf("Export: %s", e)
+	}
+	if !bytes.Equal(before.Bytes(), after.Bytes()) {
+		t.Errorf("Decrypt: data differs")
+	}
+	if e := d.Decrypt(keys); !IsError(e, E_PARAM) {
+		t.Errorf("Decrypt (again): expected E_PARAM, got %v", e)
+	}
+}
+
+func TestCreateNoFS(t *testing.T) {
+	chk(os.Mkdir("nofs", 0755))
+	p := CreateParam{Size: 64 * 1024, File: "nofs/" + baseDelta, NoFS: true}
+	if e := Create(&p); e != nil {
+		t.Fatalf("Create: %s", e)
+	}
+	dd := "nofs/DiskDescriptor.xml"
+	if _, e := FSInfo(dd); e == nil {
+		t.Errorf("FSInfo: expected an error")
+	}
+
+	nd, e := Open(dd)
+	if e != nil {
+		t.Fatalf("Open: %s", e)
+	}
+	defer nd.Close()
+	// nothing to detect, so libploop is left to fail
+	if _, e = nd.Mount(&MountParam{Target: "nofs/mnt", FSType: FSTypeAuto}); e == nil {
+		t.Errorf("Mount: expected an error")
+	}
+	if _, e = nd.Mount(&MountParam{}); e != nil {
+		t.Fatalf("Mount (device only): %s", e)
+	}
+	if e = nd.Umount(); e != nil {
+		t.Errorf("Umount: %s", e)
+	}
+}
+
+func cleanup() {
+	if m, _ := d.IsMounted(); m {
+		d.Umount()
+	}
+	d.Close()
 	if oldPwd != "" {
 		os.Chdir(oldPwd)
 	}
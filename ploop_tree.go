@@ -0,0 +1,93 @@
+package ploop
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// chainOf returns the list of snapshots from the base delta up to
+// the snapshot with a given uuid (or the current top delta, if uuid is
+// empty), i.e. in the order they are stacked in a ploop device
+func chainOf(s []SnapshotInfo, uuid string) []SnapshotInfo {
+	byUUID := make(map[string]*SnapshotInfo, len(s))
+	for n := range s {
+		byUUID[s[n].UUID] = &s[n]
+		if uuid == "" && s[n].Current {
+			uuid = s[n].UUID
+		}
+	}
+
+	var chain []SnapshotInfo
+	for uuid != NoneUUID && len(chain) < len(s) {
+		i, ok := byUUID[uuid]
+		if !ok {
+			break
+		}
+		chain = append([]SnapshotInfo{*i}, chain...)
+		uuid = i.ParentUUID
+	}
+
+	return chain
+}
+
+// deltaChain is the same as chainOf, but returns delta file names
+func deltaChain(s []SnapshotInfo, uuid string) []string {
+	var files []string
+	for _, i := range chainOf(s, uuid) {
+		files = append(files, i.File)
+	}
+	return files
+}
+
+// chainUUIDs returns uuids of the current top delta chain,
+// base delta first
+func chainUUIDs(s []SnapshotInfo) []string {
+	var uuids []string
+	for _, i := range chainOf(s, "") {
+		uuids = append(uuids, i.UUID)
+	}
+	return uuids
+}
+
+// SnapshotTree renders a list of snapshots (as returned by Snapshots())
+// as a parent/child tree, one snapshot per line, with the base delta
+// on top. The current top delta is marked with an asterisk, and
+// temporary snapshots are marked with "(temporary)".
+func SnapshotTree(s []SnapshotInfo) string {
+	var b bytes.Buffer
+
+	children := make(map[string][]int)
+	for n := range s {
+		children[s[n].ParentUUID] = append(children[s[n].ParentUUID], n)
+	}
+
+	var walk func(n int, prefix string, last bool, root bool)
+	walk = func(n int, prefix string, last bool, root bool) {
+		branch, next := "|-- ", "|   "
+		if last {
+			branch, next = "`-- ", "    "
+		}
+		if root {
+			branch, next = "", ""
+		}
+		fmt.Fprintf(&b, "%s%s%s", prefix, branch, s[n].UUID)
+		if s[n].Current {
+			b.WriteString(" *")
+		}
+		if s[n].Temporary {
+			b.WriteString(" (temporary)")
+		}
+		b.WriteString("\n")
+
+		c := children[s[n].UUID]
+		for i, cn := range c {
+			walk(cn, prefix+next, i == len(c)-1, false)
+		}
+	}
+
+	for _, n := range children[NoneUUID] {
+		walk(n, "", true, true)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,39 @@
+package ploop
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotTree(t *testing.T) {
+	s := []SnapshotInfo{
+		{UUID: "{base}", ParentUUID: NoneUUID},
+		{UUID: "{a}", ParentUUID: "{base}"},
+		{UUID: "{b}", ParentUUID: "{a}", Current: true},
+		{UUID: "{c}", ParentUUID: "{base}", Temporary: true},
+	}
+	exp := "{base}\n" +
+		"|-- {a}\n" +
+		"|   `-- {b} *\n" +
+		"`-- {c} (temporary)\n"
+
+	if out := SnapshotTree(s); out != exp {
+		t.Errorf("SnapshotTree: got\n%s\nexpected\n%s", out, exp)
+	}
+}
+
+func TestDeltaChain(t *testing.T) {
+	s := []SnapshotInfo{
+		{UUID: "{base}", ParentUUID: NoneUUID, File: "base"},
+		{UUID: "{a}", ParentUUID: "{base}", File: "a"},
+		{UUID: "{b}", ParentUUID: "{a}", File: "b", Current: true},
+		{UUID: "{c}", ParentUUID: "{base}", File: "c"},
+	}
+
+	if c := deltaChain(s, ""); fmt.Sprint(c) != "[base a b]" {
+		t.Errorf("deltaChain: unexpected result %v", c)
+	}
+	if c := deltaChain(s, "{c}"); fmt.Sprint(c) != "[base c]" {
+		t.Errorf("deltaChain: unexpected result %v", c)
+	}
+}
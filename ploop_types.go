@@ -0,0 +1,277 @@
+package ploop
+
+// Types and constants which do not depend on libploop, so that code
+// using this package (e.g. via Backend interface) can be built and
+// tested without cgo. Values of constants must be in sync with libploop,
+// this is checked at compile time in ploop_cgo.go.
+
+import "strings"
+import "time"
+
+// ImageMode is a type for CreateParam.Mode field
+type ImageMode int
+
+// Possible values for ImageMode
+const (
+	Expanded     ImageMode = 0
+	Preallocated ImageMode = 1
+	Raw          ImageMode = 2
+)
+
+// ParseImageMode converts a string to ImageMode value
+func ParseImageMode(s string) (ImageMode, error) {
+	switch strings.ToLower(s) {
+	case "expanded":
+		return Expanded, nil
+	case "preallocated":
+		return Preallocated, nil
+	case "raw":
+		return Raw, nil
+	default:
+		return Expanded, &Err{c: E_PARAM, s: "unknown image mode " + s}
+	}
+}
+
+// String converts an ImageMode value to string
+func (m ImageMode) String() string {
+	switch m {
+	case Expanded:
+		return "Expanded"
+	case Preallocated:
+		return "Preallocated"
+	case Raw:
+		return "Raw"
+	}
+	return "<unknown>"
+}
+
+// CreateFlags is a type for CreateParam.Flags
+type CreateFlags uint
+
+// Possible values for CreateFlags
+const (
+	NoLazy CreateFlags = 0x1
+)
+
+// Defaults for CreateParam fields which are not set
+const (
+	DefaultFile   = "root.hdd" // base delta image file name
+	DefaultCLog   = 11         // 2^11 sectors, i.e. 1M cluster block size
+	DefaultFSType = "ext4"     // inner file system type
+)
+
+// FSTypeAuto is a MountParam.FSType value to detect the file system type
+const FSTypeAuto = "auto"
+
+// CreateParam is a set of parameters for a newly created ploop
+type CreateParam struct {
+	Size  uint64      // image size, in kilobytes (FS size is about 10% smaller)
+	Mode  ImageMode   // image mode
+	File  string      // path to and a file name for base delta image
+	CLog  uint        // cluster block size log (6 to 15, default 11)
+	Flags CreateFlags // flags
+
+	// Inner file system options. By default, a GPT partition table is
+	// created, with a single partition holding an ext4 file system.
+	FSType      string   // file system type, e.g. "ext4" or "xfs" (see MountParam.FSType)
+	NoFS        bool     // do not create a file system (for raw block use)
+	NoPartition bool     // do not create a partition table
+	FSLabel     string   // file system label
+	InodeRatio  uint     // bytes per inode (ext file systems only)
+	MkfsOptions []string // extra options for mkfs
+
+	// Encryption options. If KeyID is set, the image is encrypted
+	// with a key having this ID, which is obtained from Keys, or,
+	// if Keys is nil, looked up by libploop's crypt helper itself.
+	// An encrypted image can only have the default file system.
+	KeyID  string      // encryption key ID (empty for no encryption)
+	Cipher string      // cipher to use (empty for the crypt helper default)
+	Keys   KeyProvider // where to get the key from
+}
+
+// FsckCode is an exit code of fsck run by Mount, a bit mask
+// of values as described in e2fsck(8)
+type FsckCode int
+
+// Possible FsckCode bits
+const (
+	FsckCorrected   FsckCode = 1   // file system errors corrected
+	FsckReboot      FsckCode = 2   // system should be rebooted
+	FsckUncorrected FsckCode = 4   // file system errors left uncorrected
+	FsckError       FsckCode = 8   // operational error
+	FsckUsage       FsckCode = 16  // usage or syntax error
+	FsckCancelled   FsckCode = 32  // fsck canceled by user request
+	FsckLibrary     FsckCode = 128 // shared library error
+)
+
+// Repaired returns true if fsck found and fixed some errors
+func (c FsckCode) Repaired() bool {
+	return c&(FsckCorrected|FsckReboot) != 0
+}
+
+// String returns a human readable summary of fsck result
+func (c FsckCode) String() string {
+	if c == 0 {
+		return "no errors"
+	}
+
+	var s []string
+	for _, b := range []struct {
+		c FsckCode
+		s string
+	}{
+		{FsckCorrected, "errors corrected"},
+		{FsckReboot, "reboot required"},
+		{FsckUncorrected, "errors left uncorrected"},
+		{FsckError, "operational error"},
+		{FsckUsage, "usage error"},
+		{FsckCancelled, "cancelled"},
+		{FsckLibrary, "shared library error"},
+	} {
+		if c&b.c != 0 {
+			s = append(s, b.s)
+		}
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// MountResult is what MountExtended() returns
+type MountResult struct {
+	Device     string   // ploop device, e.g. /dev/ploop12345
+	Partition  string   // device with the inner file system, e.g. /dev/ploop12345p1
+	MountPoint string   // where the inner file system is mounted, if it is
+	Fsck       FsckCode // fsck exit code, if fsck was requested
+	Deltas     []string // delta files attached to the device, base delta first
+}
+
+// MountParam is a set of parameters to pass to Mount()
+type MountParam struct {
+	UUID     string // snapshot uuid (empty for top delta)
+	Target   string // mount point (empty if no mount is needed)
+	Flags    int    // bit mount flags such as MS_NOATIME
+	Data     string // auxiliary mount options
+	Readonly bool   // mount read-only
+	Fsck     bool   // do fsck before mounting inner FS (ext only)
+	Quota    bool   // enable quota for inner FS (ext only)
+	// FSType is the inner file system type. If empty or ext, libploop
+	// mounts it; other types (e.g. "xfs") are mounted by Mount itself.
+	// FSTypeAuto detects the type from the image, which means reading
+	// its deltas; if the detection fails, libploop mounts it.
+	FSType string
+	// Component is a name to distinguish a mount of the same image
+	// (e.g. of its snapshot) from other ones; empty for a regular mount
+	Component string
+	// Keys is used to get the key of an encrypted image; if nil,
+	// the key is looked up by libploop's crypt helper itself
+	Keys KeyProvider
+}
+
+// ResizeParam is a set of parameters for ResizeEx
+type ResizeParam struct {
+	Size       uint64 // new size, in kilobytes (must be 0 with FSOnly)
+	Offline    bool   // resize an unmounted image, checking its file system first
+	MaxBalloon uint64 // maximum balloon file size for a shrink, in kilobytes (0 for no limit)
+	NoBalloon  bool   // shrink without a balloon file, i.e. offline (see Offline)
+	DeviceOnly bool   // only grow the image and the block device, not the inner file system
+	FSOnly     bool   // only grow the inner file system of a mounted image to fill the device
+}
+
+// ResizeResult holds sizes before and after ResizeEx, in kilobytes
+type ResizeResult struct {
+	OldSize   uint64 // image (block device) size before
+	NewSize   uint64 // image (block device) size after
+	OldFSSize uint64 // inner file system size before (0 if unknown)
+	NewFSSize uint64 // inner file system size after (0 if unknown)
+	Relocated bool   // an interrupted balloon relocation had to be completed first
+}
+
+// EncryptParam is a set of parameters for Encrypt and RotateKey
+type EncryptParam struct {
+	KeyID  string      // new encryption key ID
+	Cipher string      // cipher to use (empty for the crypt helper default)
+	Keys   KeyProvider // where to get the keys from (nil for crypt helper lookup)
+	Wipe   bool        // wipe unencrypted data left in the image files
+}
+
+// SwitchFlag is a type for SwitchSnapshotExtended.Flags
+type SwitchFlag uint
+
+const (
+	// SkipDestroy flag, if set, modifies the behavior of
+	// SwitchSnapshotExtended to not delete the old top delta, but
+	// make it a snapshot and return its uuid. Without this flag,
+	// old top delta (i.e. data modified since the last snapshot)
+	// is lost.
+	SkipDestroy SwitchFlag = 0x1
+	// SkipCreate flag, if set, modifies the behavior of
+	// SwitchSnapshotExtended to not create a new top delta,
+	// but rather transform the specified snapshot itself to be
+	// the new top delta), so all new changes will be written
+	// right to it. Snapshot UUID is lost in this case.
+	SkipCreate SwitchFlag = 0x2
+)
+
+// ReplaceFlag is a type for ReplaceParam.Flags field
+type ReplaceFlag int
+
+// Possible values for ReplaceParam.Flags field
+const (
+	// KeepName renames the new file to old file name after replace;
+	// note that if this option is used the old file is removed.
+	KeepName ReplaceFlag = 0x1
+)
+
+// ReplaceParam is a set of parameters to Replace()
+type ReplaceParam struct {
+	File string // new image file name
+	// Image to be replaced is specified by either
+	// uuid, current file name, or level,
+	// in the above order of preference.
+	UUID    string
+	CurFile string
+	Level   int
+	Flags   ReplaceFlag
+}
+
+// FSInfoData holds information about ploop inner file system
+type FSInfoData struct {
+	BlockSize  uint64
+	Blocks     uint64
+	BlocksFree uint64
+	Inodes     uint64
+	InodesFree uint64
+}
+
+// ImageInfoData holds information about ploop image
+type ImageInfoData struct {
+	Blocks    uint64
+	BlockSize uint32
+	Version   int
+}
+
+// NoneUUID is a parent UUID of the base delta
+const NoneUUID = "{00000000-0000-0000-0000-000000000000}"
+
+// SnapshotInfo holds information about a ploop snapshot
+type SnapshotInfo struct {
+	UUID       string // snapshot uuid
+	ParentUUID string // parent snapshot uuid, or NoneUUID for base delta
+	File       string // delta file name
+	ReadOnly   bool   // delta is read-only (i.e. not a top delta)
+	Temporary  bool   // snapshot is temporary
+	Current    bool   // this is the current top delta
+
+	// Metadata, for snapshots created by SnapshotExtended
+	// (see there for its limitations)
+	Description string            // human readable description
+	Created     time.Time         // creation time (zero if unknown)
+	Labels      map[string]string // key/value labels
+}
+
+// SnapshotParam is a set of parameters for SnapshotExtended
+type SnapshotParam struct {
+	Temporary   bool              // snapshot is temporary
+	Description string            // human readable description
+	Labels      map[string]string // arbitrary key/value labels
+}
@@ -0,0 +1,16 @@
+package ploop
+
+import "testing"
+
+func TestFsckCode(t *testing.T) {
+	if s := FsckCode(0).String(); s != "no errors" {
+		t.Errorf("FsckCode(0): unexpected %q", s)
+	}
+	c := FsckCorrected | FsckUncorrected
+	if s := c.String(); s != "errors corrected, errors left uncorrected" {
+		t.Errorf("FsckCode(%d): unexpected %q", c, s)
+	}
+	if !c.Repaired() || FsckError.Repaired() {
+		t.Errorf("FsckCode.Repaired: unexpected result")
+	}
+}
@@ -0,0 +1,458 @@
+// Package ploopfake provides an in-memory implementation of ploop.Backend,
+// to be used for unit testing code that uses goploop on hosts without
+// ploop kernel modules and libploop.
+//
+// The fake does not touch the file system (except for resolving relative
+// paths) and does not store any data, but it mimics libploop behavior,
+// including returned error codes, as closely as practical.
+package ploopfake
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/kolyshkin/goploop"
+)
+
+const descriptorName = "DiskDescriptor.xml"
+
+// topDeltaUUID is the uuid libploop always gives to the top delta
+// (TOPDELTA_UUID in libploop)
+const topDeltaUUID = "{5fbaabe3-6958-40ff-92a7-860e329aab41}"
+
+type snapshot struct {
+	uuid   string
+	parent string
+	file   string // absolute path
+}
+
+type image struct {
+	size      uint64 // in kilobytes
+	blocksize uint32 // in sectors
+	mode      ploop.ImageMode
+	top       string
+	snaps     []snapshot // in creation order, base delta first
+	device    string     // empty if not mounted
+	target    string
+}
+
+// Backend is an in-memory fake ploop.Backend.
+// It is safe for concurrent use.
+type Backend struct {
+	mu     sync.Mutex
+	images map[string]*image // key is absolute DiskDescriptor.xml path
+	devnum int
+	fail   map[string]error
+}
+
+// Make sure we implement the interfaces
+var _ ploop.Backend = &Backend{}
+var _ ploop.Disk = &disk{}
+
+// New creates a new empty fake backend
+func New() *Backend {
+	return &Backend{
+		images: make(map[string]*image),
+		devnum: 10000,
+		fail:   make(map[string]error),
+	}
+}
+
+// FailNext makes the next call to operation op (a name of a Backend or
+// Disk method, such as "Mount") fail with err. Use ploop.NewError to
+// create an error with a specific ploop error code.
+func (b *Backend) FailNext(op string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fail[op] = err
+}
+
+// failed checks if an operation should fail. Must be called with b.mu held.
+func (b *Backend) failed(op string) error {
+	err, ok := b.fail[op]
+	if ok {
+		delete(b.fail, op)
+	}
+	return err
+}
+
+func mkerr(code int, format string, args ...interface{}) error {
+	return ploop.NewError(code, fmt.Sprintf(format, args...))
+}
+
+func genUUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("{%x-%x-%x-%x-%x}", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// Create creates a fake ploop image
+func (b *Backend) Create(p *ploop.CreateParam) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.failed("Create"); err != nil {
+		return err
+	}
+
+	// default image file name
+	if p.File == "" {
+		p.File = "root.hdd"
+	}
+	file, err := filepath.Abs(p.File)
+	if err != nil {
+		return mkerr(ploop.E_PARAM, "can't resolve %s: %s", p.File, err)
+	}
+	dd := filepath.Join(filepath.Dir(file), descriptorName)
+
+	if p.Size == 0 {
+		return mkerr(ploop.E_PARAM, "incorrect size specified: %d", p.Size)
+	}
+	if p.Mode != ploop.Expanded && p.Mode != ploop.Preallocated && p.Mode != ploop.Raw {
+		return mkerr(ploop.E_PARAM, "incorrect mode %d", p.Mode)
+	}
+	clog := p.CLog
+	if clog == 0 {
+		clog = 11
+	}
+	if clog < 6 || clog > 15 {
+		return mkerr(ploop.E_PARAM, "incorrect blocksize specified: %d", 1<<clog)
+	}
+	if _, ok := b.images[dd]; ok {
+		return mkerr(ploop.E_PARAM, "file %s already exists", dd)
+	}
+
+	b.images[dd] = &image{
+		size:      p.Size,
+		blocksize: 1 << clog,
+		mode:      p.Mode,
+		top:       topDeltaUUID,
+		snaps:     []snapshot{{uuid: topDeltaUUID, parent: ploop.NoneUUID, file: file}},
+	}
+
+	return nil
+}
+
+// Open opens a fake ploop image created by Create
+func (b *Backend) Open(file string) (ploop.Disk, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.failed("Open"); err != nil {
+		return nil, err
+	}
+
+	dd, err := filepath.Abs(file)
+	if err != nil {
+		return nil, mkerr(ploop.E_DISKDESCR, "can't resolve %s: %s", file, err)
+	}
+	if _, ok := b.images[dd]; !ok {
+		return nil, mkerr(ploop.E_DISKDESCR, "can't resolve %s: no such file or directory", file)
+	}
+
+	return &disk{b: b, dd: dd}, nil
+}
+
+// FSInfo returns made up, but consistent, file system information
+func (b *Backend) FSInfo(file string) (ploop.FSInfoData, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.failed("FSInfo"); err != nil {
+		return ploop.FSInfoData{}, err
+	}
+
+	dd, _ := filepath.Abs(file)
+	i, ok := b.images[dd]
+	if !ok {
+		return ploop.FSInfoData{}, mkerr(ploop.E_DISKDESCR, "can't open %s", file)
+	}
+
+	// FS size is about 10% smaller than image size
+	const bsize = 4096
+	blocks := i.size * 1024 / bsize * 9 / 10
+	inodes := blocks / 4
+
+	return ploop.FSInfoData{
+		BlockSize:  bsize,
+		Blocks:     blocks,
+		BlocksFree: blocks - blocks/50,
+		Inodes:     inodes,
+		InodesFree: inodes - 11,
+	}, nil
+}
+
+// disk is a fake ploop.Disk
+type disk struct {
+	b      *Backend
+	dd     string
+	closed bool
+}
+
+// lock locks the backend and returns the image, or an error
+// if the descriptor is closed or the operation should fail
+func (d *disk) lock(op string) (*image, error) {
+	d.b.mu.Lock()
+	if d.closed {
+		return nil, mkerr(ploop.E_PARAM, "%s: disk descriptor is closed", op)
+	}
+	if err := d.b.failed(op); err != nil {
+		return nil, err
+	}
+	i, ok := d.b.images[d.dd]
+	if !ok {
+		return nil, mkerr(ploop.E_DISKDESCR, "%s: no such descriptor %s", op, d.dd)
+	}
+	return i, nil
+}
+
+func (d *disk) unlock() {
+	d.b.mu.Unlock()
+}
+
+func (i *image) find(uuid string) int {
+	for n := range i.snaps {
+		if i.snaps[n].uuid == uuid {
+			return n
+		}
+	}
+	return -1
+}
+
+func (i *image) children(uuid string) []int {
+	var ret []int
+	for n := range i.snaps {
+		if i.snaps[n].parent == uuid {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// newDelta returns a file name for a new delta, the way libploop does it
+func (i *image) newDelta(uuid string) string {
+	return i.snaps[0].file + "." + uuid
+}
+
+func (d *disk) Close() {
+	d.b.mu.Lock()
+	defer d.b.mu.Unlock()
+
+	d.closed = true
+}
+
+func (d *disk) Mount(p *ploop.MountParam) (string, error) {
+	i, err := d.lock("Mount")
+	defer d.unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if i.device != "" {
+		return "", mkerr(ploop.E_PLOOPINUSE, "image %s already used by device %s", d.dd, i.device)
+	}
+	if p.UUID != "" && i.find(p.UUID) == -1 {
+		return "", mkerr(ploop.E_NOSNAP, "can't find snapshot by uuid %s", p.UUID)
+	}
+
+	i.device = fmt.Sprintf("/dev/ploop%dp1", d.b.devnum)
+	i.target = p.Target
+	d.b.devnum++
+
+	return i.device, nil
+}
+
+func (d *disk) Umount() error {
+	i, err := d.lock("Umount")
+	defer d.unlock()
+	if err != nil {
+		return err
+	}
+
+	if i.device == "" {
+		return mkerr(ploop.E_DEV_NOT_MOUNTED, "image %s is not mounted", d.dd)
+	}
+	i.device = ""
+	i.target = ""
+
+	return nil
+}
+
+func (d *disk) Resize(size uint64, offline bool) error {
+	i, err := d.lock("Resize")
+	defer d.unlock()
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		return mkerr(ploop.E_PARAM, "incorrect size specified: %d", size)
+	}
+	if offline && i.device != "" {
+		return mkerr(ploop.E_PARAM, "unable to perform offline resize, image is mounted")
+	}
+	i.size = size
+
+	return nil
+}
+
+func (d *disk) Snapshot() (string, error) {
+	i, err := d.lock("Snapshot")
+	defer d.unlock()
+	if err != nil {
+		return "", err
+	}
+
+	// Like libploop, the current top delta becomes a snapshot
+	// with a new uuid, and a new top delta is created on top of it,
+	// keeping the constant top delta uuid
+	snap := genUUID()
+	for n := range i.snaps {
+		if i.snaps[n].uuid == i.top {
+			i.snaps[n].uuid = snap
+		}
+	}
+	i.snaps = append(i.snaps, snapshot{uuid: topDeltaUUID, parent: snap, file: i.newDelta(snap)})
+	i.top = topDeltaUUID
+
+	return snap, nil
+}
+
+func (d *disk) SwitchSnapshot(uuid string) error {
+	i, err := d.lock("SwitchSnapshot")
+	defer d.unlock()
+	if err != nil {
+		return err
+	}
+
+	if i.device != "" {
+		return mkerr(ploop.E_PARAM, "unable to perform switch to snapshot on mounted image")
+	}
+	if i.find(uuid) == -1 {
+		return mkerr(ploop.E_NOSNAP, "can't find snapshot by uuid %s", uuid)
+	}
+	if uuid == i.top {
+		return mkerr(ploop.E_PARAM, "nothing to do, already on %s snapshot", uuid)
+	}
+
+	// old top delta is destroyed
+	n := i.find(i.top)
+	i.snaps = append(i.snaps[:n], i.snaps[n+1:]...)
+	i.snaps = append(i.snaps, snapshot{uuid: topDeltaUUID, parent: uuid, file: i.newDelta(genUUID())})
+	i.top = topDeltaUUID
+
+	return nil
+}
+
+func (d *disk) DeleteSnapshot(uuid string) error {
+	i, err := d.lock("DeleteSnapshot")
+	defer d.unlock()
+	if err != nil {
+		return err
+	}
+
+	n := i.find(uuid)
+	if n == -1 {
+		return mkerr(ploop.E_NOSNAP, "can't find snapshot by uuid %s", uuid)
+	}
+	if uuid == i.top {
+		return mkerr(ploop.E_PARAM, "unable to delete active snapshot %s", uuid)
+	}
+	c := i.children(uuid)
+	if len(c) > 1 {
+		return mkerr(ploop.E_PARAM, "unable to delete snapshot %s: it has %d child snapshots", uuid, len(c))
+	}
+	if len(c) == 1 {
+		// child is merged down into this delta
+		i.snaps[c[0]].parent = i.snaps[n].parent
+		i.snaps[c[0]].file = i.snaps[n].file
+	}
+	i.snaps = append(i.snaps[:n], i.snaps[n+1:]...)
+
+	return nil
+}
+
+func (d *disk) Replace(p *ploop.ReplaceParam) error {
+	i, err := d.lock("Replace")
+	defer d.unlock()
+	if err != nil {
+		return err
+	}
+
+	n := -1
+	if p.UUID != "" {
+		n = i.find(p.UUID)
+	} else if p.CurFile != "" {
+		cur, _ := filepath.Abs(p.CurFile)
+		for k := range i.snaps {
+			if i.snaps[k].file == cur {
+				n = k
+			}
+		}
+	} else {
+		// level 0 is the base delta
+		uuid := i.top
+		var chain []int
+		for uuid != ploop.NoneUUID {
+			k := i.find(uuid)
+			chain = append([]int{k}, chain...)
+			uuid = i.snaps[k].parent
+		}
+		if p.Level >= 0 && p.Level < len(chain) {
+			n = chain[p.Level]
+		}
+	}
+	if n == -1 {
+		return mkerr(ploop.E_PARAM, "can't find image to replace")
+	}
+
+	if p.Flags&ploop.KeepName == 0 {
+		file, err := filepath.Abs(p.File)
+		if err != nil {
+			return mkerr(ploop.E_PARAM, "can't resolve %s: %s", p.File, err)
+		}
+		i.snaps[n].file = file
+	}
+
+	return nil
+}
+
+func (d *disk) IsMounted() (bool, error) {
+	i, err := d.lock("IsMounted")
+	defer d.unlock()
+	if err != nil {
+		return false, err
+	}
+
+	return i.device != "", nil
+}
+
+func (d *disk) ImageInfo() (ploop.ImageInfoData, error) {
+	i, err := d.lock("ImageInfo")
+	defer d.unlock()
+	if err != nil {
+		return ploop.ImageInfoData{}, err
+	}
+
+	return ploop.ImageInfoData{
+		Blocks:    i.size * 2, // kB to 512-byte sectors
+		BlockSize: i.blocksize,
+		Version:   2,
+	}, nil
+}
+
+func (d *disk) TopDeltaFile() (string, error) {
+	i, err := d.lock("TopDeltaFile")
+	defer d.unlock()
+	if err != nil {
+		return "", err
+	}
+
+	return i.snaps[i.find(i.top)].file, nil
+}
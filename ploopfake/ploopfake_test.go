@@ -0,0 +1,137 @@
+package ploopfake
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kolyshkin/goploop"
+)
+
+func open(t *testing.T, b *Backend) ploop.Disk {
+	if err := b.Create(&ploop.CreateParam{Size: 1 << 20, File: "/fake/root.hdd"}); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	d, err := b.Open("/fake/DiskDescriptor.xml")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	return d
+}
+
+func TestCreateOpen(t *testing.T) {
+	b := New()
+	open(t, b)
+
+	err := b.Create(&ploop.CreateParam{Size: 1 << 20, File: "/fake/root.hdd"})
+	if !ploop.IsError(err, ploop.E_PARAM) {
+		t.Errorf("Create: expected E_PARAM on existing image, got %v", err)
+	}
+	if _, err = b.Open("/nonexistent/DiskDescriptor.xml"); !ploop.IsError(err, ploop.E_DISKDESCR) {
+		t.Errorf("Open: expected E_DISKDESCR, got %v", err)
+	}
+	if _, err = b.FSInfo("/fake/DiskDescriptor.xml"); err != nil {
+		t.Errorf("FSInfo: %s", err)
+	}
+}
+
+func TestMountUmount(t *testing.T) {
+	b := New()
+	d := open(t, b)
+
+	dev, err := d.Mount(&ploop.MountParam{Target: "/mnt"})
+	if err != nil || dev == "" {
+		t.Fatalf("Mount: %q, %v", dev, err)
+	}
+	if _, err = d.Mount(&ploop.MountParam{}); !ploop.IsError(err, ploop.E_PLOOPINUSE) {
+		t.Errorf("Mount: expected E_PLOOPINUSE, got %v", err)
+	}
+	if m, _ := d.IsMounted(); !m {
+		t.Errorf("IsMounted: expected true")
+	}
+	if err = d.Umount(); err != nil {
+		t.Errorf("Umount: %s", err)
+	}
+	if err = d.Umount(); !ploop.IsNotMounted(err) {
+		t.Errorf("Umount: expected E_DEV_NOT_MOUNTED, got %v", err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	b := New()
+	d := open(t, b)
+
+	base, _ := d.TopDeltaFile()
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %s", err)
+	}
+	top, _ := d.TopDeltaFile()
+	if top == base {
+		t.Errorf("Snapshot: top delta file not changed")
+	}
+	if snap == topDeltaUUID {
+		t.Errorf("Snapshot: returned top delta uuid")
+	}
+	// top delta keeps its constant uuid
+	if err = d.SwitchSnapshot(topDeltaUUID); !ploop.IsError(err, ploop.E_PARAM) {
+		t.Errorf("SwitchSnapshot: (to top) expected E_PARAM, got %v", err)
+	}
+
+	d.Mount(&ploop.MountParam{})
+	if err = d.SwitchSnapshot(snap); !ploop.IsError(err, ploop.E_PARAM) {
+		t.Errorf("SwitchSnapshot: (online) expected E_PARAM, got %v", err)
+	}
+	d.Umount()
+
+	if err = d.SwitchSnapshot(snap); err != nil {
+		t.Errorf("SwitchSnapshot: %s", err)
+	}
+	if err = d.DeleteSnapshot("{nonexistent}"); !ploop.IsError(err, ploop.E_NOSNAP) {
+		t.Errorf("DeleteSnapshot: expected E_NOSNAP, got %v", err)
+	}
+	if err = d.DeleteSnapshot(snap); err != nil {
+		t.Errorf("DeleteSnapshot: %s", err)
+	}
+	if top, _ = d.TopDeltaFile(); top != base {
+		t.Errorf("DeleteSnapshot: expected top delta %s, got %s", base, top)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	b := New()
+	d := open(t, b)
+
+	err := d.Replace(&ploop.ReplaceParam{File: "/fake/new.hdd", CurFile: "/fake/root.hdd"})
+	if err != nil {
+		t.Fatalf("Replace: %s", err)
+	}
+	if top, _ := d.TopDeltaFile(); top != "/fake/new.hdd" {
+		t.Errorf("Replace: top delta not replaced, got %s", top)
+	}
+	err = d.Replace(&ploop.ReplaceParam{File: "/fake/new.hdd", Level: 5})
+	if !ploop.IsError(err, ploop.E_PARAM) {
+		t.Errorf("Replace: expected E_PARAM, got %v", err)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	b := New()
+	d := open(t, b)
+	e := errors.New("injected")
+
+	b.FailNext("Resize", e)
+	if err := d.Resize(1<<21, false); err != e {
+		t.Errorf("Resize: expected injected error, got %v", err)
+	}
+	if err := d.Resize(1<<21, false); err != nil {
+		t.Errorf("Resize: %s", err)
+	}
+	if i, _ := d.ImageInfo(); i.Blocks != 1<<22 {
+		t.Errorf("ImageInfo: unexpected size %d", i.Blocks)
+	}
+
+	d.Close()
+	if _, err := d.IsMounted(); err == nil {
+		t.Errorf("IsMounted: expected an error after Close")
+	}
+}
@@ -0,0 +1,355 @@
+// Package qcow2 reads and writes QEMU qcow2 disk images, to the extent
+// needed to move ploop images to and from other hypervisors, without
+// the need for cgo or any external tools.
+//
+// Only the active image (i.e. the one described by the L1 table) is
+// used. Backing files, encryption, compressed clusters, external data
+// files and extended L2 entries are not supported. Written images are
+// qcow2 version 2 (compat=0.10), readable by any qcow2 implementation.
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic is the qcow2 image signature ("QFI\xfb")
+const Magic = 0x514649fb
+
+// Sizes of on-disk header, for format version 2 and 3
+const (
+	HeaderSizeV2 = 72
+	HeaderSizeV3 = 104
+)
+
+// Supported range of Header.ClusterBits
+const (
+	MinClusterBits = 9  // 512 bytes
+	MaxClusterBits = 21 // 2 megabytes
+)
+
+// L1 and L2 table entry bits
+const (
+	oflagCopied     = 1 << 63 // refcount is exactly one
+	oflagCompressed = 1 << 62 // compressed cluster (L2 only)
+	oflagZero       = 1       // cluster reads as zeroes (L2 only, version 3)
+	offsetMask      = 0x00fffffffffffe00
+)
+
+// incompatDirty is the only incompatible feature bit which is safe
+// to ignore for reading (it means refcounts may be inconsistent)
+const incompatDirty = 1
+
+// ErrBadMagic is returned when a file is not a qcow2 image
+var ErrBadMagic = errors.New("qcow2: not a qcow2 image (bad magic)")
+
+// Header is a decoded qcow2 image header. Header extensions
+// (version 3) are not decoded.
+type Header struct {
+	Version               uint32 // format version (2 or 3)
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32 // cluster size is 1 << ClusterBits bytes
+	Size                  uint64 // virtual disk size, in bytes
+	CryptMethod           uint32
+	L1Size                uint32 // number of L1 table entries
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	// version 3 only
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32 // refcount width is 1 << RefcountOrder bits
+	HeaderLength         uint32
+}
+
+// ClusterBytes returns the cluster size in bytes
+func (h *Header) ClusterBytes() int64 {
+	return 1 << h.ClusterBits
+}
+
+// UnmarshalBinary decodes a header from its on-disk form
+func (h *Header) UnmarshalBinary(b []byte) error {
+	if len(b) < HeaderSizeV2 {
+		return io.ErrUnexpectedEOF
+	}
+	be := binary.BigEndian
+
+	if be.Uint32(b[0:]) != Magic {
+		return ErrBadMagic
+	}
+	h.Version = be.Uint32(b[4:])
+	h.BackingFileOffset = be.Uint64(b[8:])
+	h.BackingFileSize = be.Uint32(b[16:])
+	h.ClusterBits = be.Uint32(b[20:])
+	h.Size = be.Uint64(b[24:])
+	h.CryptMethod = be.Uint32(b[32:])
+	h.L1Size = be.Uint32(b[36:])
+	h.L1TableOffset = be.Uint64(b[40:])
+	h.RefcountTableOffset = be.Uint64(b[48:])
+	h.RefcountTableClusters = be.Uint32(b[56:])
+	h.NbSnapshots = be.Uint32(b[60:])
+	h.SnapshotsOffset = be.Uint64(b[64:])
+
+	switch h.Version {
+	case 2:
+		h.RefcountOrder = 4
+		h.HeaderLength = HeaderSizeV2
+	case 3:
+		if len(b) < HeaderSizeV3 {
+			return io.ErrUnexpectedEOF
+		}
+		h.IncompatibleFeatures = be.Uint64(b[72:])
+		h.CompatibleFeatures = be.Uint64(b[80:])
+		h.AutoclearFeatures = be.Uint64(b[88:])
+		h.RefcountOrder = be.Uint32(b[96:])
+		h.HeaderLength = be.Uint32(b[100:])
+	default:
+		return fmt.Errorf("qcow2: unsupported version %d", h.Version)
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes a header to its on-disk form
+func (h *Header) MarshalBinary() ([]byte, error) {
+	var b []byte
+
+	switch h.Version {
+	case 2:
+		b = make([]byte, HeaderSizeV2)
+	case 3:
+		b = make([]byte, HeaderSizeV3)
+	default:
+		return nil, fmt.Errorf("qcow2: unsupported version %d", h.Version)
+	}
+	be := binary.BigEndian
+
+	be.PutUint32(b[0:], Magic)
+	be.PutUint32(b[4:], h.Version)
+	be.PutUint64(b[8:], h.BackingFileOffset)
+	be.PutUint32(b[16:], h.BackingFileSize)
+	be.PutUint32(b[20:], h.ClusterBits)
+	be.PutUint64(b[24:], h.Size)
+	be.PutUint32(b[32:], h.CryptMethod)
+	be.PutUint32(b[36:], h.L1Size)
+	be.PutUint64(b[40:], h.L1TableOffset)
+	be.PutUint64(b[48:], h.RefcountTableOffset)
+	be.PutUint32(b[56:], h.RefcountTableClusters)
+	be.PutUint32(b[60:], h.NbSnapshots)
+	be.PutUint64(b[64:], h.SnapshotsOffset)
+	if h.Version == 3 {
+		be.PutUint64(b[72:], h.IncompatibleFeatures)
+		be.PutUint64(b[80:], h.CompatibleFeatures)
+		be.PutUint64(b[88:], h.AutoclearFeatures)
+		be.PutUint32(b[96:], h.RefcountOrder)
+		be.PutUint32(b[100:], HeaderSizeV3)
+	}
+
+	return b, nil
+}
+
+// Validate checks that the header describes an image
+// this package is able to read
+func (h *Header) Validate() error {
+	if h.ClusterBits < MinClusterBits || h.ClusterBits > MaxClusterBits {
+		return fmt.Errorf("qcow2: invalid cluster bits %d", h.ClusterBits)
+	}
+	if h.BackingFileOffset != 0 {
+		return errors.New("qcow2: images with a backing file are not supported")
+	}
+	if h.CryptMethod != 0 {
+		return errors.New("qcow2: encrypted images are not supported")
+	}
+	if h.IncompatibleFeatures&^incompatDirty != 0 {
+		return fmt.Errorf("qcow2: unsupported incompatible features %#x", h.IncompatibleFeatures)
+	}
+	if need := l1Entries(h.Size, h.ClusterBits); uint64(h.L1Size) < need {
+		return fmt.Errorf("qcow2: L1 table has %d entries, %d needed", h.L1Size, need)
+	}
+	return nil
+}
+
+// l1Entries returns the number of L1 table entries
+// needed for a disk of a given size
+func l1Entries(size uint64, bits uint32) uint64 {
+	perL1 := uint64(1) << (bits + bits - 3) // bytes covered by one L2 table
+	return (size + perL1 - 1) / perL1
+}
+
+// Image is an opened qcow2 image. It implements io.ReaderAt,
+// reading the virtual disk contents.
+type Image struct {
+	Header
+	r  io.ReaderAt
+	l1 []uint64
+
+	l2idx int64 // index of the cached L2 table, or -1
+	l2    []uint64
+}
+
+// Open reads and validates a qcow2 image header and L1 table from r
+func Open(r io.ReaderAt) (*Image, error) {
+	i := &Image{r: r, l2idx: -1}
+
+	b := make([]byte, HeaderSizeV3)
+	n, err := r.ReadAt(b, 0)
+	if n < HeaderSizeV2 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err = i.Header.UnmarshalBinary(b[:n]); err != nil {
+		return nil, err
+	}
+	if err = i.Header.Validate(); err != nil {
+		return nil, err
+	}
+
+	i.l1, err = i.readTable(int64(i.L1TableOffset), int(i.L1Size))
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: can't read L1 table: %w", err)
+	}
+
+	return i, nil
+}
+
+// readTable reads n big-endian 64-bit entries at a given offset
+func (i *Image) readTable(off int64, n int) ([]uint64, error) {
+	b := make([]byte, 8*n)
+	if _, err := i.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	t := make([]uint64, n)
+	for k := range t {
+		t[k] = binary.BigEndian.Uint64(b[8*k:])
+	}
+	return t, nil
+}
+
+// l2Table returns L2 table number idx, or nil if it is not allocated
+func (i *Image) l2Table(idx int64) ([]uint64, error) {
+	if idx == i.l2idx {
+		return i.l2, nil
+	}
+	off := int64(i.l1[idx] & offsetMask)
+	if off == 0 {
+		return nil, nil
+	}
+	t, err := i.readTable(off, int(i.ClusterBytes()/8))
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: can't read L2 table: %w", err)
+	}
+	i.l2idx, i.l2 = idx, t
+	return t, nil
+}
+
+// entryOffset returns the data offset of an L2 entry,
+// or 0 if the cluster reads as zeroes
+func (i *Image) entryOffset(e uint64) (int64, error) {
+	if e&oflagCompressed != 0 {
+		return 0, errors.New("qcow2: compressed clusters are not supported")
+	}
+	if i.Version >= 3 && e&oflagZero != 0 {
+		return 0, nil
+	}
+	return int64(e & offsetMask), nil
+}
+
+// Clusters returns the virtual disk size, in clusters
+func (i *Image) Clusters() uint64 {
+	cs := uint64(i.ClusterBytes())
+	return (i.Size + cs - 1) / cs
+}
+
+// Offset returns the byte offset of a given virtual cluster
+// inside the image file, and whether it is allocated
+func (i *Image) Offset(cluster uint64) (int64, bool, error) {
+	if cluster >= i.Clusters() {
+		return 0, false, nil
+	}
+	per := uint64(i.ClusterBytes() / 8)
+	t, err := i.l2Table(int64(cluster / per))
+	if t == nil || err != nil {
+		return 0, false, err
+	}
+	off, err := i.entryOffset(t[cluster%per])
+	return off, off != 0, err
+}
+
+// Walk calls fn for every allocated cluster, in virtual cluster order,
+// passing the virtual cluster number and its byte offset inside the
+// image file. If fn returns an error, Walk stops and returns it.
+func (i *Image) Walk(fn func(cluster uint64, offset int64) error) error {
+	per := uint64(i.ClusterBytes() / 8)
+	total := i.Clusters()
+
+	for idx := range i.l1 {
+		t, err := i.l2Table(int64(idx))
+		if err != nil {
+			return err
+		}
+		for n, e := range t {
+			c := uint64(idx)*per + uint64(n)
+			if c >= total {
+				return nil
+			}
+			off, err := i.entryOffset(e)
+			if err != nil {
+				return err
+			}
+			if off == 0 {
+				continue
+			}
+			if err = fn(c, off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadAt reads the virtual disk contents at a given offset.
+// It implements io.ReaderAt. Unallocated clusters read as zeroes.
+func (i *Image) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+	cs := i.ClusterBytes()
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= int64(i.Size) {
+			return n, io.EOF
+		}
+		in := pos % cs
+		chunk := cs - in
+		if rest := int64(i.Size) - pos; chunk > rest {
+			chunk = rest
+		}
+		if want := int64(len(b) - n); chunk > want {
+			chunk = want
+		}
+		dst := b[n : n+int(chunk)]
+
+		data, ok, err := i.Offset(uint64(pos / cs))
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			if _, err = i.r.ReadAt(dst, data+in); err != nil {
+				return n, err
+			}
+		} else {
+			clear(dst)
+		}
+		n += int(chunk)
+	}
+	return n, nil
+}
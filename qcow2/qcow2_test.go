@@ -0,0 +1,100 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestHeaderRoundtrip(t *testing.T) {
+	for _, v := range []uint32{2, 3} {
+		h := Header{Version: v, ClusterBits: 16, Size: 1 << 30, L1Size: 2,
+			L1TableOffset: 0x30000, RefcountTableOffset: 0x10000,
+			RefcountTableClusters: 1, RefcountOrder: 4, HeaderLength: HeaderSizeV2}
+		if v == 3 {
+			h.HeaderLength = HeaderSizeV3
+		}
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %s", err)
+		}
+		var h2 Header
+		if err = h2.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary: %s", err)
+		}
+		if h != h2 {
+			t.Errorf("v%d: header mismatch:\n%+v\n%+v", v, h, h2)
+		}
+		if err = h2.Validate(); err != nil {
+			t.Errorf("v%d: Validate: %s", v, err)
+		}
+	}
+}
+
+func TestBadMagic(t *testing.T) {
+	var h Header
+	if err := h.UnmarshalBinary(make([]byte, HeaderSizeV2)); err != ErrBadMagic {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+}
+
+func TestWriteOpen(t *testing.T) {
+	const bits = 9 // 64 entries per L2 table, so two tables are needed
+	const size = 100<<bits - 100
+	clusters := []uint64{1, 3, 70, 99}
+
+	var buf bytes.Buffer
+	err := Write(&buf, size, bits, clusters, func(c uint64, b []byte) error {
+		for n := range b {
+			b[n] = byte(c)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if buf.Len()%(1<<bits) != 0 {
+		t.Errorf("Write: image size %d is not cluster aligned", buf.Len())
+	}
+
+	i, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if i.Size != size || i.Clusters() != 100 {
+		t.Errorf("Open: bad size %d (%d clusters)", i.Size, i.Clusters())
+	}
+
+	var got []uint64
+	err = i.Walk(func(c uint64, off int64) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil || len(got) != len(clusters) {
+		t.Fatalf("Walk: bad result %v (err %v)", got, err)
+	}
+	for n := range got {
+		if got[n] != clusters[n] {
+			t.Errorf("Walk: expected %v, got %v", clusters, got)
+			break
+		}
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(i, 0, size))
+	if err != nil || len(data) != size {
+		t.Fatalf("ReadAt: %d bytes read (err %v)", len(data), err)
+	}
+	for _, c := range []uint64{0, 1, 2, 3, 70, 99} {
+		want := byte(0)
+		if c != 0 && c != 2 {
+			want = byte(c)
+		}
+		if data[c<<bits] != want {
+			t.Errorf("ReadAt: cluster %d: expected %d, got %d", c, want, data[c<<bits])
+		}
+	}
+
+	if err = Write(io.Discard, size, bits, []uint64{3, 1}, nil); err == nil {
+		t.Errorf("Write: expected an error for unsorted cluster list")
+	}
+}
@@ -0,0 +1,142 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Write writes a sparse qcow2 image of a given virtual size (in bytes)
+// to w, strictly sequentially, so w does not have to be seekable.
+// Cluster size is 1 << bits bytes.
+//
+// Only virtual clusters listed in clusters (which must be sorted in
+// ascending order) are stored in the image, all the others read as
+// zeroes. Data of every stored cluster is obtained by calling read,
+// which should fill in the whole of b.
+//
+// The image layout is: header, L1 table, refcount table, refcount
+// blocks, L2 tables, and data clusters, in this order.
+func Write(w io.Writer, size uint64, bits uint32, clusters []uint64,
+	read func(cluster uint64, b []byte) error) error {
+	if bits < MinClusterBits || bits > MaxClusterBits {
+		return fmt.Errorf("qcow2: invalid cluster bits %d", bits)
+	}
+	if size == 0 {
+		return fmt.Errorf("qcow2: zero disk size")
+	}
+	cs := uint64(1) << bits
+	perL2 := cs / 8 // entries per L2 table or refcount table cluster
+	perRB := cs / 2 // entries per refcount block (16-bit refcounts)
+	nclusters := (size + cs - 1) / cs
+
+	// L2 tables needed, in order
+	var l2s []uint64
+	for n, c := range clusters {
+		if c >= nclusters || (n > 0 && c <= clusters[n-1]) {
+			return fmt.Errorf("qcow2: cluster list is not sorted or out of range")
+		}
+		if t := c / perL2; len(l2s) == 0 || l2s[len(l2s)-1] != t {
+			l2s = append(l2s, t)
+		}
+	}
+
+	l1Size := l1Entries(size, bits)
+	l1Clusters := (8*l1Size + cs - 1) / cs
+	// refcount structures have to cover themselves, so find a fixpoint
+	rtClusters, rbClusters := uint64(1), uint64(1)
+	var total uint64
+	for {
+		total = 1 + l1Clusters + rtClusters + rbClusters + uint64(len(l2s)) + uint64(len(clusters))
+		rb := (total + perRB - 1) / perRB
+		rt := (rb + perL2 - 1) / perL2
+		if rb == rbClusters && rt == rtClusters {
+			break
+		}
+		rbClusters, rtClusters = rb, rt
+	}
+	l1Start := uint64(1)
+	rtStart := l1Start + l1Clusters
+	rbStart := rtStart + rtClusters
+	l2Start := rbStart + rbClusters
+	dataStart := l2Start + uint64(len(l2s))
+
+	h := Header{
+		Version:               2,
+		ClusterBits:           bits,
+		Size:                  size,
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         l1Start * cs,
+		RefcountTableOffset:   rtStart * cs,
+		RefcountTableClusters: uint32(rtClusters),
+	}
+	hb, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	be := binary.BigEndian
+	buf := make([]byte, cs)
+	// put writes n clusters of table entries, as filled in by fn
+	put := func(n uint64, fn func(b []byte)) error {
+		b := make([]byte, n*cs)
+		fn(b)
+		_, err := w.Write(b)
+		return err
+	}
+
+	// header
+	copy(buf, hb)
+	if _, err = w.Write(buf); err != nil {
+		return err
+	}
+	// L1 table
+	err = put(l1Clusters, func(b []byte) {
+		for n, t := range l2s {
+			be.PutUint64(b[8*t:], (l2Start+uint64(n))*cs|oflagCopied)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// refcount table
+	err = put(rtClusters, func(b []byte) {
+		for n := uint64(0); n < rbClusters; n++ {
+			be.PutUint64(b[8*n:], (rbStart+n)*cs)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// refcount blocks
+	err = put(rbClusters, func(b []byte) {
+		for n := uint64(0); n < total; n++ {
+			be.PutUint16(b[2*n:], 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// L2 tables
+	k := 0
+	for _, t := range l2s {
+		clear(buf)
+		for ; k < len(clusters) && clusters[k]/perL2 == t; k++ {
+			be.PutUint64(buf[8*(clusters[k]%perL2):], (dataStart+uint64(k))*cs|oflagCopied)
+		}
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+	}
+	// data
+	for _, c := range clusters {
+		if err = read(c, buf); err != nil {
+			return err
+		}
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}